@@ -12,15 +12,24 @@ func main() {
 	input, err := common.GetInput()
 	common.HandleFatalError(err, "Error getting concourse input")
 
-	checklib.ValidateInput(input)
+	err = checklib.ValidateInput(input)
 	common.HandleFatalError(err, "Error while validating input")
 
 	branches := []string{}
 	updatedBranches := checklib.InitUpdatedBranches(input)
 	branchToCommitMap := checklib.GetBranchToCommitMap(input)
-
-	branches, updatedBranches = checklib.ParseStashBranches(branches, updatedBranches, branchToCommitMap, checklib.GetStashBranches(input), input)
-	updatedBranches = checklib.SetBranchesNode(updatedBranches, branches)
+	state := checklib.NewCheckState(input)
+
+	for _, repoInput := range checklib.RepoInputs(input) {
+		branches, updatedBranches = checklib.ProcessStashBranches(branches, updatedBranches, branchToCommitMap, checklib.GetStashRepoBranches(repoInput), repoInput, state)
+	}
+	updatedBranches = checklib.SkipBuiltCommits(updatedBranches, input)
+	if input.Source.CompactVersions {
+		updatedBranches = checklib.SetCompactNode(updatedBranches, branches, input, state)
+	} else {
+		updatedBranches = checklib.SetWatermarkNode(updatedBranches, input, state)
+		updatedBranches = checklib.SetBranchesNode(updatedBranches, branches)
+	}
 
 	output, err := json.Marshal(updatedBranches)
 	common.HandleFatalError(err, "Error marshaling concourse output")
@@ -4,21 +4,60 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
-	"net/http"
+	"os"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
 	"../common"
 )
 
-// StashBranchPullRequest the structure of the pull request response from Stash
-type StashBranchPullRequest struct {
-	State string `json:"state"`
-	ID    int    `json:"id"`
+// DefaultPageSize the number of branches or pull requests requested per page when the source doesn't set page_size
+const DefaultPageSize = 1000
+
+// DefaultWIPPattern the pattern of the titles of work in progress pull requests when the source doesn't set wip_pattern
+const DefaultWIPPattern = `^(WIP|\[WIP\]|Draft)`
+
+// draftState and unapprovedState the states recorded after the sha of a held back pull request
+const (
+	draftState      = "draft"
+	unapprovedState = "unapproved"
+)
+
+// commentStatePrefix the prefix of the state recording the id of the latest comment of a pull request
+const commentStatePrefix = "comment-"
+
+// triggerCommentActivities the number of latest activities of a pull request scanned for trigger comments
+const triggerCommentActivities = 100
+
+// requiredReviewersGroupPrefix the prefix of the required_reviewers entries naming a group instead of a user
+const requiredReviewersGroupPrefix = "group:"
+
+// CheckState the state shared by the branches processed during a check
+type CheckState struct {
+	groupMembers map[string][]common.StashUser
+	// watermark the latest update of the listed pull requests, starting from the watermark of the previous version
+	watermark int64
+}
+
+// NewCheckState returns the state of a new check
+func NewCheckState(input common.ConcourseInput) *CheckState {
+	return &CheckState{
+		groupMembers: map[string][]common.StashUser{},
+		watermark:    previousWatermark(input),
+	}
 }
 
+// DefaultMaxChanges the number of changes after which a pull request is considered to touch every path
+const DefaultMaxChanges = 5000
+
+// DefaultMaxCommits the number of latest commits of a push emitted as versions with every_commit, when the source doesn't set max_commits
+const DefaultMaxCommits = 100
+
+// StashBranchPullRequest the structure of the pull request response from Stash
+type StashBranchPullRequest = common.StashPullRequest
+
 // StashBranchPullRequestMD the structure of the pull request metadata response from Stash
 type StashBranchPullRequestMD struct {
 	PullRequest StashBranchPullRequest `json:"pullRequest"`
@@ -27,8 +66,9 @@ type StashBranchPullRequestMD struct {
 
 // StashBranchLatestCommitMD the structure of the commit metadata response from Stash
 type StashBranchLatestCommitMD struct {
-	Timestamp int64  `json:"authorTimestamp"`
-	Message   string `json:"message"`
+	Timestamp int64            `json:"authorTimestamp"`
+	Message   string           `json:"message"`
+	Author    common.StashUser `json:"author"`
 }
 
 // StashBranchMetadata the structure of the branch metadata response from Stash
@@ -42,6 +82,9 @@ type StashBranch struct {
 	DisplayID    string              `json:"displayId"`
 	LatestCommit string              `json:"latestCommit"`
 	Metadata     StashBranchMetadata `json:"metadata"`
+
+	// latestCommitPending is true for the branches of pull requests whose latest commit metadata is only read when needed
+	latestCommitPending bool
 }
 
 // StashBranches the structure of the branches response from Stash
@@ -51,8 +94,9 @@ type StashBranches struct {
 
 // StashPullRequestChangePage the structure of the pull request change page response from Stash
 type StashPullRequestChangePage struct {
-	Changes    []StashPullRequestChange `json:"values"`
-	IsLastPage bool                     `json:"isLastPage"`
+	Changes       []StashPullRequestChange `json:"values"`
+	IsLastPage    bool                     `json:"isLastPage"`
+	NextPageStart int                      `json:"nextPageStart"`
 }
 
 // StashPullRequestChange the structure of the pull request change response from Stash
@@ -68,12 +112,203 @@ type StashPullRequestPath struct {
 
 // ValidateInput returns an errors object if validation doesn't pass, nil otherwise
 func ValidateInput(input common.ConcourseInput) error {
-	if !input.Source.PROnly && len(input.Source.Paths) > 0 {
-		return errors.New("Cannot pass paths when pronly is false")
+	if !input.Source.PROnly && (len(input.Source.Paths) > 0 || len(input.Source.IgnorePaths) > 0) {
+		return errors.New("Cannot pass paths or ignore_paths when pronly is false")
+	}
+
+	if _, err := NewPathMatcher(SourcePathPatterns(input.Source)); err != nil {
+		return err
+	}
+
+	if input.Source.CompactVersions && !pullRequestMode(input) {
+		return errors.New("Cannot pass compact_versions without the pull_requests mode")
+	}
+
+	if input.Source.EveryCommit && input.Source.CompactVersions {
+		return errors.New("Cannot pass both every_commit and compact_versions")
+	}
+
+	if input.Source.MaxCommits < 0 {
+		return errors.New("Cannot pass a negative max_commits")
+	}
+
+	if len(input.Source.Repos) > 0 && input.Source.RepoPattern != "" {
+		return errors.New("Cannot pass both repos and repo_pattern")
+	}
+
+	if multiRepo(input) && input.Source.RepoName != "" {
+		return errors.New("Cannot pass repo_name with repos or repo_pattern")
+	}
+
+	if input.Source.RepoPattern != "" {
+		if _, err := regexp.Compile(input.Source.RepoPattern); err != nil {
+			return fmt.Errorf("Invalid repo_pattern '%s': %s", input.Source.RepoPattern, err.Error())
+		}
+	}
+
+	if input.Source.TargetBranches != "" {
+		if _, err := regexp.Compile(input.Source.TargetBranches); err != nil {
+			return fmt.Errorf("Invalid target_branches '%s': %s", input.Source.TargetBranches, err.Error())
+		}
+	}
+
+	if input.Source.IgnoreTargetBranches != "" {
+		if _, err := regexp.Compile(input.Source.IgnoreTargetBranches); err != nil {
+			return fmt.Errorf("Invalid ignore_target_branches '%s': %s", input.Source.IgnoreTargetBranches, err.Error())
+		}
+	}
+
+	if input.Source.TriggerComment != "" {
+		if _, err := regexp.Compile(input.Source.TriggerComment); err != nil {
+			return fmt.Errorf("Invalid trigger_comment '%s': %s", input.Source.TriggerComment, err.Error())
+		}
+	}
+
+	// the pipeline would otherwise run the code of anyone able to fork the repo with its credentials
+	if input.Source.Forks && len(input.Source.ForkTrustedReviewers) == 0 {
+		return errors.New("Cannot pass forks without fork_trusted_reviewers")
+	}
+
+	if input.Source.MinApprovals < 0 {
+		return errors.New("Cannot pass a negative min_approvals")
+	}
+
+	if input.Source.WIPPattern != "" {
+		if _, err := regexp.Compile(input.Source.WIPPattern); err != nil {
+			return fmt.Errorf("Invalid wip_pattern '%s': %s", input.Source.WIPPattern, err.Error())
+		}
+	}
+
+	for _, author := range append(append([]string{}, input.Source.Authors...), input.Source.IgnoreAuthors...) {
+		if _, err := regexp.Compile(author); err != nil {
+			return fmt.Errorf("Invalid author pattern '%s': %s", author, err.Error())
+		}
+	}
+
+	if input.Source.Mode != "" && input.Source.Mode != common.ModeBranches && input.Source.Mode != common.ModePullRequests {
+		return fmt.Errorf("Unknown mode '%s'", input.Source.Mode)
 	}
 	return nil
 }
 
+func pullRequestMode(input common.ConcourseInput) bool {
+	return input.Source.Mode == common.ModePullRequests
+}
+
+func multiRepo(input common.ConcourseInput) bool {
+	return len(input.Source.Repos) > 0 || input.Source.RepoPattern != ""
+}
+
+// RepoInputs returns one input per repo watched by the source
+func RepoInputs(input common.ConcourseInput) []common.ConcourseInput {
+	if !multiRepo(input) {
+		return []common.ConcourseInput{input}
+	}
+
+	repos := input.Source.Repos
+	if input.Source.RepoPattern != "" {
+		pageSize := input.Source.PageSize
+		if pageSize <= 0 {
+			pageSize = DefaultPageSize
+		}
+
+		repositories, err := common.GetStashProjectRepos(input.Source, pageSize)
+		common.HandleFatalError(err, "Error getting stash repos of project "+input.Source.ProjectName)
+
+		rRepoPattern := regexp.MustCompile(input.Source.RepoPattern)
+		repos = []string{}
+		for _, repository := range repositories {
+			if rRepoPattern.MatchString(repository.Slug) {
+				repos = append(repos, repository.Slug)
+			}
+		}
+	}
+
+	repoInputs := []common.ConcourseInput{}
+	for _, repo := range repos {
+		repoInput := input
+		repoInput.Source.RepoName = repo
+		repoInputs = append(repoInputs, repoInput)
+	}
+
+	return repoInputs
+}
+
+// GetStashRepoBranches returns the branches or, in pull_requests mode, the pull requests of the repo of the source to process
+func GetStashRepoBranches(input common.ConcourseInput) []StashBranch {
+	if pullRequestMode(input) {
+		return GetStashPullRequestBranches(input)
+	}
+
+	stashBranches := GetStashBranches(input)
+	if input.Source.Forks {
+		stashBranches.Branches = append(stashBranches.Branches, GetStashForkPullRequestBranches(input)...)
+	}
+
+	return stashBranches.Branches
+}
+
+// versionKey returns the key identifying the branch in the flattened list of branches and sha's, the pull request id in pull_requests mode
+func versionKey(branch StashBranch, input common.ConcourseInput) string {
+	// keys of the branches of every watched repo are prefixed with the repo
+	if multiRepo(input) {
+		return input.Source.RepoName + "/" + repoVersionKey(branch, input)
+	}
+
+	return repoVersionKey(branch, input)
+}
+
+func repoVersionKey(branch StashBranch, input common.ConcourseInput) string {
+	pullRequest := branch.Metadata.PullRequestMD.PullRequest
+	if pullRequestMode(input) {
+		return strconv.Itoa(pullRequest.ID)
+	}
+
+	// branches of forks are prefixed with their repo, so as not to collide with the branches of the same name in the repo
+	if forkBranch(branch) {
+		return fmt.Sprintf("%s/%s/%s", pullRequest.FromRef.Repository.Project.Key, pullRequest.FromRef.Repository.Slug, branch.DisplayID)
+	}
+
+	// with target branch filters a branch is considered once per pull request, each of them is listed with its id
+	if hasTargetBranchFilters(input) && pullRequest.ID != 0 {
+		return fmt.Sprintf("%s#%d", branch.DisplayID, pullRequest.ID)
+	}
+
+	return branch.DisplayID
+}
+
+func forkBranch(branch StashBranch) bool {
+	pullRequest := branch.Metadata.PullRequestMD.PullRequest
+	return pullRequest.State != "" && pullRequest.FromRef.Repository.Slug != "" && pullRequest.IsFork()
+}
+
+func newVersion(branch StashBranch, input common.ConcourseInput) *common.ConcourseVersion {
+	version := &common.ConcourseVersion{
+		ChangedBranch: branch.DisplayID,
+		Ref:           branch.LatestCommit,
+	}
+
+	// with target branch filters the version tells in which of the pull requests of the branch passed them,
+	// and the branch of a fork can only be found through its pull request
+	if pullRequestMode(input) || forkBranch(branch) || (hasTargetBranchFilters(input) && branch.Metadata.PullRequestMD.PullRequest.ID != 0) {
+		pullRequest := branch.Metadata.PullRequestMD.PullRequest
+		version.PullRequestID = strconv.Itoa(pullRequest.ID)
+		version.TargetBranch = pullRequest.ToRef.DisplayID
+		version.TargetRef = pullRequest.ToRef.LatestCommit
+	}
+
+	if multiRepo(input) {
+		version.Repo = input.Source.RepoName
+	}
+
+	if forkBranch(branch) {
+		version.SourceProject = branch.Metadata.PullRequestMD.PullRequest.FromRef.Repository.Project.Key
+		version.SourceRepo = branch.Metadata.PullRequestMD.PullRequest.FromRef.Repository.Slug
+	}
+
+	return version
+}
+
 func filterOutByDateAndTime(latestCommitTime int64, input common.ConcourseInput) bool {
 	if input.Source.DaysBack > 0 {
 		cutOffTime := time.Now().Add(time.Hour*24*time.Duration(-input.Source.DaysBack)).UnixNano() / 1000000
@@ -104,8 +339,97 @@ func filterOutByBranchName(branch StashBranch, input common.ConcourseInput) bool
 	return false
 }
 
+func hasTargetBranchFilters(input common.ConcourseInput) bool {
+	return input.Source.TargetBranches != "" || input.Source.IgnoreTargetBranches != ""
+}
+
+// filterOutByTargetBranchName filters out branches whose pull request target is unknown or excluded by the target branch filters
+func filterOutByTargetBranchName(branch StashBranch, input common.ConcourseInput) bool {
+	if !hasTargetBranchFilters(input) {
+		return false
+	}
+
+	targetBranch := branch.Metadata.PullRequestMD.PullRequest.ToRef.DisplayID
+	if targetBranch == "" {
+		return true
+	}
+
+	if input.Source.TargetBranches != "" {
+		rTargetBranches := regexp.MustCompile(input.Source.TargetBranches)
+		if !rTargetBranches.MatchString(targetBranch) {
+			return true
+		}
+	}
+
+	if input.Source.IgnoreTargetBranches != "" {
+		rIgnoreTargetBranches := regexp.MustCompile(input.Source.IgnoreTargetBranches)
+		if rIgnoreTargetBranches.MatchString(targetBranch) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// branchPullRequests returns the branch once per open pull request when the target branch filters need it, the branch otherwise
+func branchPullRequests(branch StashBranch, input common.ConcourseInput) []StashBranch {
+	if pullRequestMode(input) || !hasTargetBranchFilters(input) || branch.Metadata.PullRequestMD.Open < 2 {
+		return []StashBranch{branch}
+	}
+
+	pullRequests, err := common.GetStashPullRequestsForBranch(input.Source, branch.DisplayID)
+	common.HandleFatalError(err, "Error getting stash pull requests of branch "+branch.DisplayID)
+
+	branches := []StashBranch{}
+	for _, pullRequest := range pullRequests {
+		pullRequestBranch := branch
+		pullRequestBranch.Metadata.PullRequestMD.PullRequest = pullRequest
+		pullRequestBranch.Metadata.PullRequestMD.Open = 1
+		branches = append(branches, pullRequestBranch)
+	}
+
+	return branches
+}
+
+// filterOutByAuthor filters out branches whose author isn't in authors or is in ignore_authors
+func filterOutByAuthor(branch StashBranch, input common.ConcourseInput) bool {
+	users := []common.StashUser{branch.Metadata.PullRequestMD.PullRequest.Author.User}
+	if input.Source.MatchCommitAuthor {
+		users = append(users, branch.Metadata.LatestCommitMD.Author)
+	}
+
+	if len(input.Source.Authors) > 0 && !authorMatches(input.Source.Authors, users) {
+		return true
+	}
+
+	if len(input.Source.IgnoreAuthors) > 0 && authorMatches(input.Source.IgnoreAuthors, users) {
+		return true
+	}
+
+	return false
+}
+
+// authorMatches returns true if one of the patterns matches the whole name, email, slug or display name of one of the users
+func authorMatches(patterns []string, users []common.StashUser) bool {
+	for _, pattern := range patterns {
+		rAuthor := regexp.MustCompile("^(?:" + pattern + ")$")
+		for _, user := range users {
+			for _, identity := range []string{user.Name, user.EmailAddress, user.Slug, user.DisplayName} {
+				if identity != "" && rAuthor.MatchString(identity) {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
 func commitMarkedAsSkip(branch StashBranch) bool {
-	message := branch.Metadata.LatestCommitMD.Message
+	return markedAsSkip(branch.Metadata.LatestCommitMD.Message)
+}
+
+func markedAsSkip(message string) bool {
 	if strings.Contains(message, "[ci skip]") || strings.Contains(message, "[skip ci]") {
 		return true
 	}
@@ -113,9 +437,11 @@ func commitMarkedAsSkip(branch StashBranch) bool {
 	return false
 }
 
-func notANewCommit(branch StashBranch, branchToCommitMap map[string]string) bool {
-	if previousLatestCommit, ok := branchToCommitMap[branch.DisplayID]; ok {
-		if previousLatestCommit == branch.LatestCommit {
+// notANewCommit returns true if the branch was listed with the same sha and no held back state by the previous version
+func notANewCommit(branch StashBranch, branchToCommitMap map[string]string, input common.ConcourseInput) bool {
+	if previousEntry, ok := branchToCommitMap[versionKey(branch, input)]; ok {
+		previousLatestCommit, previousState := splitBranchEntryValue(previousEntry)
+		if previousLatestCommit == branch.LatestCommit && previousState != draftState && previousState != unapprovedState {
 			return true
 		}
 	}
@@ -123,6 +449,208 @@ func notANewCommit(branch StashBranch, branchToCommitMap map[string]string) bool
 	return false
 }
 
+// splitBranchEntryValue returns the sha and the optional state of a value of the map returned by GetBranchToCommitMap
+func splitBranchEntryValue(value string) (string, string) {
+	shaAndState := strings.SplitN(value, common.BranchesSeperator, 2)
+	if len(shaAndState) < 2 {
+		return shaAndState[0], ""
+	}
+
+	return shaAndState[0], shaAndState[1]
+}
+
+// workInProgress returns true if skip_wip is set and the pull request of the branch is a draft or has a work in progress title
+func workInProgress(branch StashBranch, input common.ConcourseInput) bool {
+	pullRequest := branch.Metadata.PullRequestMD.PullRequest
+	if !input.Source.SkipWIP || pullRequest.State == "" {
+		return false
+	}
+
+	return pullRequest.Draft || wipTitle(pullRequest.Title, input)
+}
+
+func wipTitle(title string, input common.ConcourseInput) bool {
+	wipPattern := input.Source.WIPPattern
+	if wipPattern == "" {
+		wipPattern = DefaultWIPPattern
+	}
+
+	return regexp.MustCompile(wipPattern).MatchString(title)
+}
+
+// unapproved returns true if the pull request of the branch has neither min_approvals approvals nor one from required_reviewers
+func unapproved(branch StashBranch, input common.ConcourseInput, state *CheckState) bool {
+	if input.Source.MinApprovals <= 0 && len(input.Source.RequiredReviewers) == 0 {
+		return false
+	}
+
+	pullRequest := branch.Metadata.PullRequestMD.PullRequest
+	if pullRequest.State == "" {
+		return true
+	}
+
+	approvers := pullRequestApprovers(pullRequest, "")
+	if input.Source.MinApprovals > 0 && len(approvers) >= input.Source.MinApprovals {
+		return false
+	}
+
+	for _, approver := range approvers {
+		if len(input.Source.RequiredReviewers) > 0 && stashUserIn(approver, input.Source.RequiredReviewers, input, state) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// pullRequestApprovers returns the distinct reviewers and participants who approved the pull request, at the given commit when set
+func pullRequestApprovers(pullRequest StashBranchPullRequest, commit string) []common.StashUser {
+	approvers := []common.StashUser{}
+	seen := map[string]bool{}
+
+	for _, participant := range append(append([]common.StashParticipant{}, pullRequest.Reviewers...), pullRequest.Participants...) {
+		if commit != "" && participant.LastReviewedCommit != commit {
+			continue
+		}
+		if (participant.Approved || participant.Status == "APPROVED") && !seen[participant.User.Name] {
+			seen[participant.User.Name] = true
+			approvers = append(approvers, participant.User)
+		}
+	}
+
+	return approvers
+}
+
+// stashUserIn returns true if the user is one of the given users, or a member of one of the given groups prefixed with group:
+func stashUserIn(user common.StashUser, reviewers []string, input common.ConcourseInput, state *CheckState) bool {
+	for _, reviewer := range reviewers {
+		if !strings.HasPrefix(reviewer, requiredReviewersGroupPrefix) {
+			if sameStashUser(user, reviewer) {
+				return true
+			}
+			continue
+		}
+
+		group := strings.TrimPrefix(reviewer, requiredReviewersGroupPrefix)
+		members, ok := state.groupMembers[group]
+		if !ok {
+			var err error
+			members, err = common.GetStashGroupMembers(input.Source, group)
+			common.HandleFatalError(err, "Error getting stash members of group "+group)
+			state.groupMembers[group] = members
+		}
+
+		for _, member := range members {
+			if sameStashUser(user, member.Name) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// triggerComments returns the ids of the trigger comments above afterID, oldest first, and the id of the latest comment
+func triggerComments(branch StashBranch, afterID int, input common.ConcourseInput, state *CheckState) ([]int, int) {
+	pullRequest := branch.Metadata.PullRequestMD.PullRequest
+	latestID := afterID
+	if latestID < 0 {
+		latestID = 0
+	}
+
+	watermark := previousWatermark(input)
+	if input.Source.TriggerComment == "" || pullRequest.State == "" || (watermark > 0 && pullRequest.UpdatedDate <= watermark) {
+		return nil, latestID
+	}
+
+	// without the watermark of a previous version only the latest activities are read
+	var activities []common.StashActivity
+	var err error
+	if watermark > 0 {
+		activities, err = common.GetStashPullRequestActivitiesSince(input.Source, pullRequest.ID, watermark)
+	} else {
+		activities, err = common.GetStashPullRequestActivities(input.Source, pullRequest.ID, triggerCommentActivities)
+	}
+	common.HandleFatalError(err, "Error getting stash pull request activities")
+
+	for _, activity := range activities {
+		if activity.Comment != nil && activity.Comment.ID > latestID {
+			latestID = activity.Comment.ID
+		}
+	}
+
+	if afterID < 0 {
+		return nil, latestID
+	}
+
+	return matchingTriggerComments(activities, afterID, input, state), latestID
+}
+
+// matchingTriggerComments returns the ids above afterID of the comments matching trigger_comment, oldest first, among the given activities listed newest first
+func matchingTriggerComments(activities []common.StashActivity, afterID int, input common.ConcourseInput, state *CheckState) []int {
+	if input.Source.TriggerComment == "" {
+		return nil
+	}
+
+	rTriggerComment := regexp.MustCompile(input.Source.TriggerComment)
+
+	commentIDs := []int{}
+	for i := len(activities) - 1; i >= 0; i-- {
+		comment := activities[i].Comment
+		if activities[i].Action != "COMMENTED" || activities[i].CommentAction != "ADDED" || comment == nil {
+			continue
+		}
+
+		if comment.ID <= afterID || !rTriggerComment.MatchString(comment.Text) {
+			continue
+		}
+
+		if len(input.Source.TriggerCommentUsers) > 0 && !stashUserIn(comment.Author, input.Source.TriggerCommentUsers, input, state) {
+			continue
+		}
+
+		commentIDs = append(commentIDs, comment.ID)
+	}
+
+	return commentIDs
+}
+
+// previousCommentID returns the id of the latest comment recorded for the branch by the previous version, -1 when there is none
+func previousCommentID(branch StashBranch, branchToCommitMap map[string]string, input common.ConcourseInput) int {
+	_, previousState := splitBranchEntryValue(branchToCommitMap[versionKey(branch, input)])
+	if !strings.HasPrefix(previousState, commentStatePrefix) {
+		return -1
+	}
+
+	commentID, err := strconv.Atoi(strings.TrimPrefix(previousState, commentStatePrefix))
+	if err != nil {
+		return -1
+	}
+
+	return commentID
+}
+
+func sameStashUser(user common.StashUser, name string) bool {
+	return strings.EqualFold(user.Name, name) || strings.EqualFold(user.Slug, name) || strings.EqualFold(user.EmailAddress, name)
+}
+
+// untrustedFork returns true if the pull request of the branch comes from a fork which none of the fork_trusted_reviewers approved
+func untrustedFork(branch StashBranch, input common.ConcourseInput, state *CheckState) bool {
+	if !forkBranch(branch) {
+		return false
+	}
+
+	// approvals aren't reset by new commits, only those of the latest commit of the fork are trusted
+	pullRequest := branch.Metadata.PullRequestMD.PullRequest
+	for _, approver := range pullRequestApprovers(pullRequest, pullRequest.FromRef.LatestCommit) {
+		if stashUserIn(approver, input.Source.ForkTrustedReviewers, input, state) {
+			return false
+		}
+	}
+
+	return true
+}
+
 func noOpenPR(branch StashBranch) bool {
 	if branch.Metadata.PullRequestMD.PullRequest.State == "OPEN" || branch.Metadata.PullRequestMD.Open > 0 {
 		return false
@@ -132,15 +660,18 @@ func noOpenPR(branch StashBranch) bool {
 }
 
 func pathNotInPrs(branch StashBranch, input common.ConcourseInput) bool {
-	if len(input.Source.Paths) > 0 && len(branch.Metadata.PullRequestMD.PullRequest.State) > 0 {
-		pullRequestChangedPaths := getStashBranchPullRequestChangePaths(input, branch.Metadata.PullRequestMD.PullRequest.ID)
-		for _, changedPath := range pullRequestChangedPaths {
-			for _, desiredPath := range input.Source.Paths {
+	patterns := SourcePathPatterns(input.Source)
+	if len(patterns) > 0 && len(branch.Metadata.PullRequestMD.PullRequest.State) > 0 {
+		matcher, err := NewPathMatcher(patterns)
+		common.HandleFatalError(err, "Error parsing paths")
 
-				//this is just string matching instead of actual path matching, but that is ok as a first pass
-				if strings.HasPrefix(changedPath, desiredPath) {
-					return false
-				}
+		pullRequestChangedPaths, touchesEverything := getStashBranchPullRequestChangePaths(input, branch.Metadata.PullRequestMD.PullRequest.ID)
+		if touchesEverything {
+			return false
+		}
+		for _, changedPath := range pullRequestChangedPaths {
+			if matcher.Matches(changedPath) {
+				return false
 			}
 		}
 		return true
@@ -149,57 +680,252 @@ func pathNotInPrs(branch StashBranch, input common.ConcourseInput) bool {
 }
 
 func processBranch(branches []string, updatedBranches []*common.ConcourseVersion,
-	branchToCommitMap map[string]string, branch StashBranch, input common.ConcourseInput) ([]string, []*common.ConcourseVersion) {
+	branchToCommitMap map[string]string, branch StashBranch, input common.ConcourseInput, state *CheckState) ([]string, []*common.ConcourseVersion) {
+
+	if latestCommitNeeded(branch, branchToCommitMap, input) {
+		branch = withLatestCommit(branch, input)
+	}
 
 	branchDateAndTime := branch.Metadata.LatestCommitMD.Timestamp
 
 	if input.Source.PROnly {
 		if noOpenPR(branch) {
-			return branches, updatedBranches
+			return filteredOut(branches, branch, branchToCommitMap, input), updatedBranches
 		}
 	}
 
 	if filterOutByDateAndTime(branchDateAndTime, input) {
-		return branches, updatedBranches
+		return filteredOut(branches, branch, branchToCommitMap, input), updatedBranches
 	}
 
 	if filterOutByBranchName(branch, input) {
-		return branches, updatedBranches
+		return filteredOut(branches, branch, branchToCommitMap, input), updatedBranches
 	}
 
-	if commitMarkedAsSkip(branch) {
+	// with every_commit the commits marked as skip are left out one by one
+	if commitMarkedAsSkip(branch) && !input.Source.EveryCommit {
 		return branches, updatedBranches
 	}
 
+	if filterOutByTargetBranchName(branch, input) {
+		return filteredOut(branches, branch, branchToCommitMap, input), updatedBranches
+	}
+
+	if filterOutByAuthor(branch, input) {
+		return filteredOut(branches, branch, branchToCommitMap, input), updatedBranches
+	}
+
 	if pathNotInPrs(branch, input) {
-		return branches, updatedBranches
+		return filteredOut(branches, branch, branchToCommitMap, input), updatedBranches
+	}
+
+	// work in progress pull requests are listed with their state so that a version is emitted once they leave it
+	if workInProgress(branch, input) {
+		return appendBranchEntry(branches, heldBack(branch, branchToCommitMap, input), draftState, input), updatedBranches
+	}
+
+	// pull requests without the required approvals are listed the same way so that a version is emitted once they get them
+	if unapproved(branch, input, state) || untrustedFork(branch, input, state) {
+		return appendBranchEntry(branches, heldBack(branch, branchToCommitMap, input), unapprovedState, input), updatedBranches
 	}
 
-	branches = append(branches, fmt.Sprintf("%s%s%s", branch.DisplayID, common.BranchesSeperator, branch.LatestCommit))
+	if compactChanges(input) {
+		return appendBranchEntry(branches, branch, "", input), appendCompactUpdates(updatedBranches, branch, input, state)
+	}
+
+	// the comments of a new commit are only recorded, the latest of them is kept so that later ones trigger the same commit again
+	newCommit := !notANewCommit(branch, branchToCommitMap, input)
+	afterID := -1
+	if !newCommit {
+		afterID = previousCommentID(branch, branchToCommitMap, input)
+	}
+
+	commentIDs, latestCommentID := triggerComments(branch, afterID, input, state)
+	if input.Source.TriggerComment == "" || input.Source.CompactVersions {
+		branches = appendBranchEntry(branches, branch, "", input)
+	} else {
+		branches = appendBranchEntry(branches, branch, commentStatePrefix+strconv.Itoa(latestCommentID), input)
+	}
+
+	if !newCommit {
+		// the latest commit of a pull request is only read once it would be built again
+		if len(commentIDs) > 0 {
+			branch = withLatestCommit(branch, input)
+			if commitMarkedAsSkip(branch) {
+				return branches, updatedBranches
+			}
+		}
+
+		for _, commentID := range commentIDs {
+			version := newVersion(branch, input)
+			version.CommentID = strconv.Itoa(commentID)
+			updatedBranches = append(updatedBranches, version)
+		}
 
-	if notANewCommit(branch, branchToCommitMap) {
 		return branches, updatedBranches
 	}
 
-	updatedBranches = append(updatedBranches, &common.ConcourseVersion{
-		ChangedBranch: branch.DisplayID,
-		Ref:           branch.LatestCommit,
-	})
+	return branches, appendCommitVersions(updatedBranches, branchToCommitMap, branch, input)
+}
 
-	return branches, updatedBranches
+// filteredOut returns the branches, with the previous entry of the filtered out branch kept for every_commit
+func filteredOut(branches []string, branch StashBranch, branchToCommitMap map[string]string, input common.ConcourseInput) []string {
+	key := versionKey(branch, input)
+	previousEntry, ok := branchToCommitMap[key]
+	if !input.Source.EveryCommit || !ok {
+		return branches
+	}
+
+	return append(branches, key+common.BranchesSeperator+previousEntry)
 }
 
-// GetBranchToCommitMap returns a map from the flattened list of branches and sha's
+// heldBack returns the branch to list in a held back state, with the sha of the previous version kept for every_commit
+func heldBack(branch StashBranch, branchToCommitMap map[string]string, input common.ConcourseInput) StashBranch {
+	previousEntry, ok := branchToCommitMap[versionKey(branch, input)]
+	if input.Source.EveryCommit && ok {
+		branch.LatestCommit, _ = splitBranchEntryValue(previousEntry)
+	}
+
+	return branch
+}
+
+// appendCommitVersions appends the version of the latest commit, preceded for every_commit by the commits pushed since the previous version
+func appendCommitVersions(updatedBranches []*common.ConcourseVersion,
+	branchToCommitMap map[string]string, branch StashBranch, input common.ConcourseInput) []*common.ConcourseVersion {
+
+	previousEntry, ok := branchToCommitMap[versionKey(branch, input)]
+	// the commits of a fork aren't in the repo
+	if !input.Source.EveryCommit || !ok || forkBranch(branch) {
+		return appendLatestCommitVersion(updatedBranches, branch, input)
+	}
+
+	maxCommits := input.Source.MaxCommits
+	if maxCommits <= 0 {
+		maxCommits = DefaultMaxCommits
+	}
+
+	previousLatestCommit, _ := splitBranchEntryValue(previousEntry)
+	commits, more, err := common.GetStashLatestCommits(input.Source, branch.LatestCommit, previousLatestCommit, maxCommits)
+	// the previous sha is no longer known when the branch was force-pushed
+	if err != nil || len(commits) == 0 {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: could not list the commits of branch %s since %s, only its latest commit is considered: %s\n",
+				branch.DisplayID, previousLatestCommit, err.Error())
+		}
+		return appendLatestCommitVersion(updatedBranches, branch, input)
+	}
+
+	if more {
+		fmt.Fprintf(os.Stderr, "Warning: more than %d commits were pushed to branch %s, only the latest %d were considered\n",
+			maxCommits, branch.DisplayID, maxCommits)
+	}
+
+	for i := len(commits) - 1; i >= 0; i-- {
+		if markedAsSkip(commits[i].Message) {
+			continue
+		}
+
+		version := newVersion(branch, input)
+		version.Ref = commits[i].ID
+		updatedBranches = append(updatedBranches, version)
+	}
+
+	return updatedBranches
+}
+
+func appendLatestCommitVersion(updatedBranches []*common.ConcourseVersion, branch StashBranch, input common.ConcourseInput) []*common.ConcourseVersion {
+	if commitMarkedAsSkip(branch) {
+		return updatedBranches
+	}
+
+	return append(updatedBranches, newVersion(branch, input))
+}
+
+// appendBranchEntry appends the branch and its sha, followed by the given state when there is one, to the flattened list of branches and sha's
+func appendBranchEntry(branches []string, branch StashBranch, state string, input common.ConcourseInput) []string {
+	branchEntry := fmt.Sprintf("%s%s%s", versionKey(branch, input), common.BranchesSeperator, branch.LatestCommit)
+	if state != "" {
+		branchEntry += common.BranchesSeperator + state
+	}
+
+	// a branch with several pull requests is processed once per pull request but listed once
+	if len(branches) > 0 && branches[len(branches)-1] == branchEntry {
+		return branches
+	}
+
+	return append(branches, branchEntry)
+}
+
+// GetBranchToCommitMap returns a map from the flattened list of branches and sha's, to the sha followed by the state of the branch when there is one
 func GetBranchToCommitMap(input common.ConcourseInput) map[string]string {
 	branchToCommitMap := map[string]string{}
 	for _, branch := range input.Version.Branches {
-		branchCommit := strings.Split(branch, common.BranchesSeperator)
+		branchCommit := strings.SplitN(branch, common.BranchesSeperator, 2)
 		branchToCommitMap[branchCommit[0]] = branchCommit[1]
 	}
 
 	return branchToCommitMap
 }
 
+// SkipBuiltCommits returns the updated branches without the new versions whose commit already has a successful skip_built_status_key build
+func SkipBuiltCommits(updatedBranches []*common.ConcourseVersion, input common.ConcourseInput) []*common.ConcourseVersion {
+	if input.Source.SkipBuiltStatusKey == "" {
+		return updatedBranches
+	}
+
+	// when every new version is skipped the branches aren't recorded, the same commits are then looked up again by the next check
+	refs := []string{}
+	for _, updatedBranch := range updatedBranches {
+		if pendingVersion(updatedBranch) && updatedBranch.CommentID == "" && !containsString(refs, updatedBranch.Ref) {
+			refs = append(refs, updatedBranch.Ref)
+		}
+	}
+	if len(refs) == 0 {
+		return updatedBranches
+	}
+
+	// the counts of every commit are fetched at once, the statuses only of the commits with a successful build
+	stats, err := common.GetStashBuildStats(input.Source, refs)
+	common.HandleFatalError(err, "Error getting stash build status counts")
+
+	built := map[string]bool{}
+	for _, ref := range refs {
+		if stats[ref].Successful == 0 {
+			continue
+		}
+
+		buildStatuses, err := common.GetStashBuildStatuses(input.Source, ref)
+		common.HandleFatalError(err, "Error getting stash build statuses of commit "+ref)
+
+		for _, buildStatus := range buildStatuses {
+			if buildStatus.Key == input.Source.SkipBuiltStatusKey && buildStatus.State == "SUCCESSFUL" {
+				built[ref] = true
+				break
+			}
+		}
+	}
+
+	unbuiltBranches := []*common.ConcourseVersion{}
+	for _, updatedBranch := range updatedBranches {
+		if pendingVersion(updatedBranch) && updatedBranch.CommentID == "" && built[updatedBranch.Ref] {
+			continue
+		}
+		unbuiltBranches = append(unbuiltBranches, updatedBranch)
+	}
+
+	return unbuiltBranches
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
 // SetBranchesNode returns a list of updated branches only
 func SetBranchesNode(updatedBranches []*common.ConcourseVersion, branches []string) []*common.ConcourseVersion {
 	for _, updatedBranch := range updatedBranches {
@@ -211,61 +937,144 @@ func SetBranchesNode(updatedBranches []*common.ConcourseVersion, branches []stri
 	return updatedBranches
 }
 
-// ParseStashBranches returns a populated list of all branches and updatedBranches after a post-filtering process
-func ParseStashBranches(branches []string, updatedBranches []*common.ConcourseVersion,
-	branchToCommitMap map[string]string, respBody []byte, input common.ConcourseInput) ([]string, []*common.ConcourseVersion) {
+// ProcessStashBranches returns a populated list of all branches and updatedBranches after a post-filtering process of the given branches
+func ProcessStashBranches(branches []string, updatedBranches []*common.ConcourseVersion,
+	branchToCommitMap map[string]string, stashBranches []StashBranch, input common.ConcourseInput, state *CheckState) ([]string, []*common.ConcourseVersion) {
 
-	stashBranches := StashBranches{}
-	err := json.Unmarshal(respBody, &stashBranches)
-	common.HandleFatalError(err, "Error parsing stash branches response json")
+	if watermarked(input) {
+		observeListedPullRequests(stashBranches, state)
+	}
 
-	for _, branch := range stashBranches.Branches {
-		branches, updatedBranches = processBranch(branches, updatedBranches, branchToCommitMap, branch, input)
+	for _, stashBranch := range stashBranches {
+		for _, branch := range branchPullRequests(stashBranch, input) {
+			branches, updatedBranches = processBranch(branches, updatedBranches, branchToCommitMap, branch, input, state)
+		}
 	}
 
 	return branches, updatedBranches
 }
 
-// GetStashBranches returns the response of a call to the Stash service returning all branches associated to a given project and repo
-func GetStashBranches(input common.ConcourseInput) []byte {
-	url := fmt.Sprintf("https://%s:%s@%s/rest/api/1.0/projects/%s/repos/%s/branches?limit=1000&details=true",
-		input.Source.Username,
-		input.Source.Password,
-		input.Source.StashUrl,
-		input.Source.ProjectName,
-		input.Source.RepoName)
+// GetStashPullRequestBranches returns the open pull requests of the repo as one branch each, so that the filters of branches mode apply
+func GetStashPullRequestBranches(input common.ConcourseInput) []StashBranch {
+	return getStashPullRequestBranches(input, input.Source.Forks, true)
+}
+
+// GetStashForkPullRequestBranches returns the open pull requests from forks of the repo as one branch each
+func GetStashForkPullRequestBranches(input common.ConcourseInput) []StashBranch {
+	return getStashPullRequestBranches(input, true, false)
+}
+
+func getStashPullRequestBranches(input common.ConcourseInput, forks bool, repo bool) []StashBranch {
+	values := getStashPagedValues(input, common.StashRepoURL(input.Source, "/pull-requests?state=OPEN"), "pull requests")
 
-	resp, err := http.DefaultClient.Get(url)
-	common.HandleFatalError(err, "Error getting stash response")
+	branches := []StashBranch{}
+	for _, value := range values {
+		pullRequest := common.StashPullRequest{}
+		err := json.Unmarshal(value, &pullRequest)
+		common.HandleFatalError(err, "Error parsing stash pull requests response json")
 
-	respBody, err := ioutil.ReadAll(resp.Body)
-	common.HandleFatalError(err, "Error reading stash response")
+		if (pullRequest.IsFork() && !forks) || (!pullRequest.IsFork() && !repo) {
+			continue
+		}
 
-	if resp.StatusCode != 200 {
-		fmt.Printf(string(respBody))
-		common.HandleFatalError(
-			fmt.Errorf("Expected 200 response code but got %v from %s", resp.StatusCode, url),
-			"Error reading stash branches response",
-		)
+		branch := pullRequestBranch(pullRequest, common.StashCommit{})
+		branch.latestCommitPending = true
+		branches = append(branches, branch)
 	}
 
-	return respBody
+	return branches
 }
 
-func getStashBranchPullRequestChangePage(url string) StashPullRequestChangePage {
-	resp, err := http.DefaultClient.Get(url)
-	common.HandleFatalError(err, "Error getting stash response")
+// latestCommitNeeded returns true if the filters need the latest commit of the branch or the previous version didn't see it
+func latestCommitNeeded(branch StashBranch, branchToCommitMap map[string]string, input common.ConcourseInput) bool {
+	if !branch.latestCommitPending {
+		return false
+	}
+
+	if input.Source.DaysBack > 0 || (input.Source.MatchCommitAuthor && len(input.Source.Authors)+len(input.Source.IgnoreAuthors) > 0) {
+		return true
+	}
+
+	if compactChanges(input) {
+		return branch.Metadata.PullRequestMD.PullRequest.UpdatedDate > previousWatermark(input)
+	}
+
+	previousEntry, ok := branchToCommitMap[versionKey(branch, input)]
+	previousLatestCommit, _ := splitBranchEntryValue(previousEntry)
+	return !ok || previousLatestCommit != branch.LatestCommit
+}
+
+// withLatestCommit returns the branch of a pull request with the metadata of its latest commit read from Stash
+func withLatestCommit(branch StashBranch, input common.ConcourseInput) StashBranch {
+	if !branch.latestCommitPending {
+		return branch
+	}
 
-	respBody, err := ioutil.ReadAll(resp.Body)
-	common.HandleFatalError(err, "Error reading stash response")
+	pullRequest := branch.Metadata.PullRequestMD.PullRequest
 
-	if resp.StatusCode != 200 {
-		fmt.Printf(string(respBody))
-		common.HandleFatalError(
-			fmt.Errorf("Expected 200 response code but got %v from %s", resp.StatusCode, url),
-			"Error reading stash pull request response",
-		)
+	// the commits of a fork may only be reachable through its pull request
+	var commit common.StashCommit
+	var err error
+	if pullRequest.IsFork() {
+		commit, err = common.GetStashPullRequestLatestCommit(input.Source, pullRequest.ID)
+	} else {
+		commit, err = common.GetStashCommit(input.Source, pullRequest.FromRef.LatestCommit)
 	}
+	common.HandleFatalError(err, "Error getting stash pull request commit")
+
+	return pullRequestBranch(pullRequest, commit)
+}
+
+func pullRequestBranch(pullRequest common.StashPullRequest, commit common.StashCommit) StashBranch {
+	branch := StashBranch{}
+	branch.DisplayID = pullRequest.FromRef.DisplayID
+	branch.LatestCommit = pullRequest.FromRef.LatestCommit
+	branch.Metadata.LatestCommitMD.Timestamp = commit.AuthorTimestamp
+	branch.Metadata.LatestCommitMD.Message = commit.Message
+	branch.Metadata.LatestCommitMD.Author = commit.Author
+	branch.Metadata.PullRequestMD.PullRequest = pullRequest
+	branch.Metadata.PullRequestMD.Open = 1
+
+	return branch
+}
+
+// GetStashBranches returns the branches of the Stash repo of the source, following every page up to max_branches
+func GetStashBranches(input common.ConcourseInput) StashBranches {
+	values := getStashPagedValues(input, common.StashRepoURL(input.Source, "/branches?details=true"), "branches")
+
+	stashBranches := StashBranches{Branches: []StashBranch{}}
+	for _, value := range values {
+		branch := StashBranch{}
+		err := json.Unmarshal(value, &branch)
+		common.HandleFatalError(err, "Error parsing stash branches response json")
+
+		stashBranches.Branches = append(stashBranches.Branches, branch)
+	}
+
+	return stashBranches
+}
+
+// getStashPagedValues returns the values of every page of the given Stash URL, warning when the bound of the source is hit
+func getStashPagedValues(input common.ConcourseInput, url string, description string) []json.RawMessage {
+	pageSize := input.Source.PageSize
+	if pageSize <= 0 {
+		pageSize = DefaultPageSize
+	}
+
+	values, more, err := common.GetStashPagedValues(url, pageSize, input.Source.MaxBranches)
+	common.HandleFatalError(err, fmt.Sprintf("Error getting stash %s", description))
+
+	if more {
+		fmt.Fprintf(os.Stderr, "Warning: more than %d %s were found, only the first %d were considered\n",
+			input.Source.MaxBranches, description, input.Source.MaxBranches)
+	}
+
+	return values
+}
+
+func getStashBranchPullRequestChangePage(url string) StashPullRequestChangePage {
+	respBody, err := common.GetStashResponse(url)
+	common.HandleFatalError(err, "Error reading stash pull request response")
 
 	pullRequestChangePage := StashPullRequestChangePage{}
 	err = json.Unmarshal(respBody, &pullRequestChangePage)
@@ -274,26 +1083,37 @@ func getStashBranchPullRequestChangePage(url string) StashPullRequestChangePage
 	return pullRequestChangePage
 }
 
-func getStashBranchPullRequestChangePaths(input common.ConcourseInput, pullRequestID int) []string {
-	url := fmt.Sprintf("https://%s:%s@%s/rest/api/1.0/projects/%s/repos/%s/pull-requests/%v/changes",
-		input.Source.Username,
-		input.Source.Password,
-		input.Source.StashUrl,
-		input.Source.ProjectName,
-		input.Source.RepoName,
-		pullRequestID)
-	pullRequestChangePage := getStashBranchPullRequestChangePage(url)
-
-	if !pullRequestChangePage.IsLastPage {
-		common.HandleFatalError(
-			errors.New("Pull requests with paged change list is not yet implemented.  This PR is too large for this resource to handle"),
-			"Error parsing stash pull request response json",
-		)
+// getStashBranchPullRequestChangePaths returns the changed paths of the pull request, or true if it has more than max_changes
+func getStashBranchPullRequestChangePaths(input common.ConcourseInput, pullRequestID int) ([]string, bool) {
+	maxChanges := input.Source.MaxChanges
+	if maxChanges <= 0 {
+		maxChanges = DefaultMaxChanges
 	}
 
-	pullRequestChangePages := []StashPullRequestChangePage{pullRequestChangePage}
+	pullRequestChangePages := []StashPullRequestChangePage{}
+	changes := 0
+	start := 0
+
+	for {
+		url := common.StashRepoURL(input.Source, "/pull-requests/%v/changes?start=%d", pullRequestID, start)
+		pullRequestChangePage := getStashBranchPullRequestChangePage(url)
+		pullRequestChangePages = append(pullRequestChangePages, pullRequestChangePage)
+		changes += len(pullRequestChangePage.Changes)
+
+		if pullRequestChangePage.IsLastPage || len(pullRequestChangePage.Changes) == 0 {
+			break
+		}
+
+		if changes >= maxChanges {
+			fmt.Fprintf(os.Stderr, "Warning: pull request %v has more than %d changes, it is considered to touch every path\n",
+				pullRequestID, maxChanges)
+			return nil, true
+		}
+
+		start = pullRequestChangePage.NextPageStart
+	}
 
-	return buildPullRequestChangesPathArray(pullRequestChangePages)
+	return buildPullRequestChangesPathArray(pullRequestChangePages), false
 }
 
 func buildPullRequestChangesPathArray(pullRequestChangePages []StashPullRequestChangePage) []string {
@@ -313,7 +1133,7 @@ func buildPullRequestChangesPathArray(pullRequestChangePages []StashPullRequestC
 // InitUpdatedBranches appends version information to each updated branch returned from Stash
 func InitUpdatedBranches(input common.ConcourseInput) []*common.ConcourseVersion {
 	updatedBranches := []*common.ConcourseVersion{}
-	if len(input.Version.Branches) > 0 {
+	if len(input.Version.Branches) > 0 || input.Version.Snapshot != "" {
 		updatedBranches = append(updatedBranches, &input.Version)
 	}
 
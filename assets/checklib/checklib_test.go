@@ -1,6 +1,11 @@
 package checklib
 
 import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -75,7 +80,7 @@ func TestProcessBranch_NoFilter_Single(t *testing.T) {
 	branch := getBranchFixture()
 	input := getConcourseInputFixture()
 
-	branches, updatedBranches = processBranch(branches, updatedBranches, branchToCommitMap, branch, input)
+	branches, updatedBranches = processBranch(branches, updatedBranches, branchToCommitMap, branch, input, NewCheckState(input))
 
 	if len(branches) != 1 {
 		t.Error("Expected branches to have length 1, got ", len(branches))
@@ -97,7 +102,7 @@ func TestProcessBranch_NoFilter_Multiple(t *testing.T) {
 	branch := getBranchFixture()
 	input := getConcourseInputFixture()
 
-	branches, updatedBranches = processBranch(branches, updatedBranches, branchToCommitMap, branch, input)
+	branches, updatedBranches = processBranch(branches, updatedBranches, branchToCommitMap, branch, input, NewCheckState(input))
 
 	if len(branches) != 2 {
 		t.Error("Expected branches to have length 1, got ", len(branches))
@@ -123,7 +128,7 @@ func TestProcessBranch_Filter_IgnoreBranches_true(t *testing.T) {
 	input := getConcourseInputFixture()
 
 	input.Source.IgnoreBranches = "feature/my-branch"
-	branches, updatedBranches = processBranch(branches, updatedBranches, branchToCommitMap, branch, input)
+	branches, updatedBranches = processBranch(branches, updatedBranches, branchToCommitMap, branch, input, NewCheckState(input))
 	if len(branches) != 0 {
 		t.Error("Expected branches to have length 0, got ", len(branches))
 	}
@@ -140,7 +145,7 @@ func TestProcessBranch_Filter_IgnoreBranches_false(t *testing.T) {
 	input := getConcourseInputFixture()
 
 	input.Source.IgnoreBranches = "feature/my-branch1"
-	branches, updatedBranches = processBranch(branches, updatedBranches, branchToCommitMap, branch, input)
+	branches, updatedBranches = processBranch(branches, updatedBranches, branchToCommitMap, branch, input, NewCheckState(input))
 	if len(branches) != 1 {
 		t.Error("Expected branches to have length 1, got ", len(branches))
 	}
@@ -157,7 +162,7 @@ func TestProcessBranch_Filter_IncludeBranches_true(t *testing.T) {
 	input := getConcourseInputFixture()
 
 	input.Source.Branches = "feature/my-branch"
-	branches, updatedBranches = processBranch(branches, updatedBranches, branchToCommitMap, branch, input)
+	branches, updatedBranches = processBranch(branches, updatedBranches, branchToCommitMap, branch, input, NewCheckState(input))
 	if len(branches) != 1 {
 		t.Error("Expected branches to have length 1, got ", len(branches))
 	}
@@ -174,7 +179,7 @@ func TestProcessBranch_Filter_IncludeBranches_false(t *testing.T) {
 	input := getConcourseInputFixture()
 
 	input.Source.Branches = "feature/my-branch1"
-	branches, updatedBranches = processBranch(branches, updatedBranches, branchToCommitMap, branch, input)
+	branches, updatedBranches = processBranch(branches, updatedBranches, branchToCommitMap, branch, input, NewCheckState(input))
 	if len(branches) != 0 {
 		t.Error("Expected branches to have length 0, got ", len(branches))
 	}
@@ -192,7 +197,7 @@ func TestProcessBranch_Filter_DateTime_true(t *testing.T) {
 
 	input.Source.DaysBack = 1
 
-	branches, updatedBranches = processBranch(branches, updatedBranches, branchToCommitMap, branch, input)
+	branches, updatedBranches = processBranch(branches, updatedBranches, branchToCommitMap, branch, input, NewCheckState(input))
 	if len(branches) != 0 {
 		t.Error("Expected branches to have length 0, got ", len(branches))
 	}
@@ -210,7 +215,7 @@ func TestProcessBranch_Filter_DateTime_false(t *testing.T) {
 
 	input.Source.DaysBack = 3
 
-	branches, updatedBranches = processBranch(branches, updatedBranches, branchToCommitMap, branch, input)
+	branches, updatedBranches = processBranch(branches, updatedBranches, branchToCommitMap, branch, input, NewCheckState(input))
 	if len(branches) != 1 {
 		t.Error("Expected branches to have length 1, got ", len(branches))
 	}
@@ -218,3 +223,1019 @@ func TestProcessBranch_Filter_DateTime_false(t *testing.T) {
 		t.Error("Expected updatedBranches to have length 1, got ", len(updatedBranches))
 	}
 }
+
+func getPullRequestFixture() common.StashPullRequest {
+	pullRequest := common.StashPullRequest{}
+	pullRequest.ID = 42
+	pullRequest.State = "OPEN"
+	pullRequest.FromRef.DisplayID = "feature/my-branch"
+	pullRequest.FromRef.LatestCommit = "my-latest-commit-sha"
+	pullRequest.ToRef.DisplayID = "master"
+	pullRequest.ToRef.LatestCommit = "my-target-commit-sha"
+
+	return pullRequest
+}
+
+func TestValidateInput_UnknownMode(t *testing.T) {
+	input := getConcourseInputFixture()
+	input.Source.Mode = "tags"
+
+	err := ValidateInput(input)
+
+	if err == nil {
+		t.Error("Expected non-nil error, got nil")
+	}
+}
+
+func TestPullRequestBranch(t *testing.T) {
+	commit := common.StashCommit{AuthorTimestamp: 1540000000000, Message: "my commit message [ci skip]"}
+
+	branch := pullRequestBranch(getPullRequestFixture(), commit)
+
+	if branch.DisplayID != "feature/my-branch" || branch.LatestCommit != "my-latest-commit-sha" {
+		t.Error("Expected branch to be the source of the pull request, got ", branch.DisplayID, branch.LatestCommit)
+	}
+
+	if branch.Metadata.PullRequestMD.PullRequest.ID != 42 || noOpenPR(branch) {
+		t.Error("Expected branch to carry the open pull request, got ", branch.Metadata.PullRequestMD)
+	}
+
+	if !commitMarkedAsSkip(branch) {
+		t.Error("Expected branch to carry the message of the latest commit")
+	}
+}
+
+func TestProcessBranch_PullRequestMode(t *testing.T) {
+	branches := []string{}
+	updatedBranches := []*common.ConcourseVersion{}
+	branchToCommitMap := map[string]string{}
+	branch := pullRequestBranch(getPullRequestFixture(), common.StashCommit{AuthorTimestamp: getBranchFixture().Metadata.LatestCommitMD.Timestamp})
+	input := getConcourseInputFixture()
+	input.Source.Mode = common.ModePullRequests
+
+	branches, updatedBranches = processBranch(branches, updatedBranches, branchToCommitMap, branch, input, NewCheckState(input))
+
+	if len(branches) != 1 || branches[0] != "42::my-latest-commit-sha" {
+		t.Error("Expected branches to be keyed by pull request id, got ", branches)
+	}
+
+	if len(updatedBranches) != 1 {
+		t.Error("Expected updatedBranches to have length 1, got ", len(updatedBranches))
+	} else {
+		version := updatedBranches[0]
+		if version.PullRequestID != "42" || version.TargetBranch != "master" || version.TargetRef != "my-target-commit-sha" {
+			t.Error("Expected version to carry the pull request and its target, got ", version)
+		}
+	}
+}
+
+func TestProcessBranch_PullRequestMode_NotANewCommit(t *testing.T) {
+	branches := []string{}
+	updatedBranches := []*common.ConcourseVersion{}
+	branchToCommitMap := map[string]string{"42": "my-latest-commit-sha"}
+	branch := pullRequestBranch(getPullRequestFixture(), common.StashCommit{})
+	input := getConcourseInputFixture()
+	input.Source.Mode = common.ModePullRequests
+
+	branches, updatedBranches = processBranch(branches, updatedBranches, branchToCommitMap, branch, input, NewCheckState(input))
+
+	if len(branches) != 1 {
+		t.Error("Expected branches to have length 1, got ", len(branches))
+	}
+	if len(updatedBranches) != 0 {
+		t.Error("Expected updatedBranches to have length 0, got ", len(updatedBranches))
+	}
+}
+
+func getStashServerFixture(t *testing.T, handler http.HandlerFunc) (*httptest.Server, common.ConcourseInput) {
+	server := httptest.NewTLSServer(handler)
+
+	defaultClient := http.DefaultClient
+	http.DefaultClient = server.Client()
+	t.Cleanup(func() {
+		http.DefaultClient = defaultClient
+		server.Close()
+	})
+
+	input := getConcourseInputFixture()
+	input.Source.StashUrl = strings.TrimPrefix(server.URL, "https://")
+	input.Source.ProjectName = "my_project"
+	input.Source.RepoName = "my_repo"
+
+	return server, input
+}
+
+func getValuesHandler(values ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"values":[%s],"isLastPage":true}`, strings.Join(values, ","))
+	}
+}
+
+func getPagedValuesHandler(total int, pageSize int, value func(i int) string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start, _ := strconv.Atoi(r.URL.Query().Get("start"))
+		limit := pageSize
+		if limit == 0 {
+			limit, _ = strconv.Atoi(r.URL.Query().Get("limit"))
+		}
+
+		values := []string{}
+		end := start
+		for ; end < total && end < start+limit; end++ {
+			values = append(values, value(end))
+		}
+
+		fmt.Fprintf(w, `{"values":[%s],"isLastPage":%t,"nextPageStart":%d}`, strings.Join(values, ","), end >= total, end)
+	}
+}
+
+func getUnexpectedRequestHandler(t *testing.T) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Unexpected request ", r.Method, r.URL.String())
+	}
+}
+
+func getBranchesPageHandler(total int) http.HandlerFunc {
+	return getPagedValuesHandler(total, 0, func(i int) string {
+		return fmt.Sprintf(`{"displayId":"feature/branch-%d","latestCommit":"sha-%d"}`, i, i)
+	})
+}
+
+func TestGetStashBranches_MultiplePages(t *testing.T) {
+	_, input := getStashServerFixture(t, getBranchesPageHandler(25))
+	input.Source.PageSize = 10
+
+	stashBranches := GetStashBranches(input)
+
+	if len(stashBranches.Branches) != 25 {
+		t.Error("Expected branches to have length 25, got ", len(stashBranches.Branches))
+	} else if stashBranches.Branches[24].DisplayID != "feature/branch-24" {
+		t.Error("Expected last branch to be feature/branch-24, got ", stashBranches.Branches[24].DisplayID)
+	}
+}
+
+func TestGetStashBranches_MaxBranches(t *testing.T) {
+	_, input := getStashServerFixture(t, getBranchesPageHandler(25))
+	input.Source.PageSize = 10
+	input.Source.MaxBranches = 12
+
+	stashBranches := GetStashBranches(input)
+
+	if len(stashBranches.Branches) != 12 {
+		t.Error("Expected branches to have length 12, got ", len(stashBranches.Branches))
+	}
+}
+
+func getChangesPageHandler(total int, pageSize int) http.HandlerFunc {
+	return getPagedValuesHandler(total, pageSize, func(i int) string {
+		return fmt.Sprintf(`{"path":{"parent":"dir-%d","name":"file-%d.go"}}`, i, i)
+	})
+}
+
+func TestBuildPullRequestChangesPathArray_MultiplePages(t *testing.T) {
+	pages := []StashPullRequestChangePage{
+		{Changes: []StashPullRequestChange{{Path: StashPullRequestPath{Parent: "src", Name: "main.go"}}}},
+		{Changes: []StashPullRequestChange{{Path: StashPullRequestPath{Name: "README.md"}}}, IsLastPage: true},
+	}
+
+	paths := buildPullRequestChangesPathArray(pages)
+
+	if len(paths) != 2 || paths[0] != "src/main.go" || paths[1] != "README.md" {
+		t.Error("Expected paths to be [src/main.go README.md], got ", paths)
+	}
+}
+
+func TestGetStashBranchPullRequestChangePaths_MultiplePages(t *testing.T) {
+	_, input := getStashServerFixture(t, getChangesPageHandler(25, 10))
+
+	paths, touchesEverything := getStashBranchPullRequestChangePaths(input, 1)
+
+	if touchesEverything {
+		t.Error("Expected touchesEverything to be false, got true")
+	}
+	if len(paths) != 25 {
+		t.Error("Expected paths to have length 25, got ", len(paths))
+	} else if paths[24] != "dir-24/file-24.go" {
+		t.Error("Expected last path to be dir-24/file-24.go, got ", paths[24])
+	}
+}
+
+func TestGetStashBranchPullRequestChangePaths_MaxChanges(t *testing.T) {
+	_, input := getStashServerFixture(t, getChangesPageHandler(25, 10))
+	input.Source.MaxChanges = 15
+
+	_, touchesEverything := getStashBranchPullRequestChangePaths(input, 1)
+
+	if !touchesEverything {
+		t.Error("Expected touchesEverything to be true, got false")
+	}
+}
+
+func TestProcessBranch_Filter_Paths_MaxChanges(t *testing.T) {
+	_, input := getStashServerFixture(t, getChangesPageHandler(25, 10))
+	input.Source.Paths = []string{"not/changed"}
+	input.Source.MaxChanges = 15
+
+	branches, updatedBranches := processBranch([]string{}, []*common.ConcourseVersion{}, map[string]string{}, getBranchFixture(), input, NewCheckState(input))
+
+	if len(branches) != 1 {
+		t.Error("Expected branches to have length 1, got ", len(branches))
+	}
+	if len(updatedBranches) != 1 {
+		t.Error("Expected updatedBranches to have length 1, got ", len(updatedBranches))
+	}
+}
+
+func TestProcessBranch_Filter_IgnorePaths(t *testing.T) {
+	_, input := getStashServerFixture(t, getValuesHandler(`{"path":{"parent":"docs","name":"index.md"}}`))
+	input.Source.IgnorePaths = []string{"docs"}
+
+	branches, updatedBranches := processBranch([]string{}, []*common.ConcourseVersion{}, map[string]string{}, getBranchFixture(), input, NewCheckState(input))
+
+	if len(branches) != 0 {
+		t.Error("Expected branches to have length 0, got ", len(branches))
+	}
+	if len(updatedBranches) != 0 {
+		t.Error("Expected updatedBranches to have length 0, got ", len(updatedBranches))
+	}
+}
+
+func TestValidateInput_IgnorePathsExists_PrOnlyFalse(t *testing.T) {
+	input := getConcourseInputFixture()
+	input.Source.IgnorePaths = []string{"docs"}
+	input.Source.PROnly = false
+
+	err := ValidateInput(input)
+
+	if err == nil {
+		t.Error("Expected non-nil error, got nil")
+	}
+}
+
+func TestProcessBranch_Filter_TargetBranches_true(t *testing.T) {
+	input := getConcourseInputFixture()
+	input.Source.TargetBranches = "^release/.*"
+	branch := getBranchFixture()
+	branch.Metadata.PullRequestMD.PullRequest = getPullRequestFixture()
+
+	branches, updatedBranches := processBranch([]string{}, []*common.ConcourseVersion{}, map[string]string{}, branch, input, NewCheckState(input))
+
+	if len(branches) != 0 {
+		t.Error("Expected branches to have length 0, got ", len(branches))
+	}
+	if len(updatedBranches) != 0 {
+		t.Error("Expected updatedBranches to have length 0, got ", len(updatedBranches))
+	}
+}
+
+func TestProcessBranch_Filter_IgnoreTargetBranches_false(t *testing.T) {
+	input := getConcourseInputFixture()
+	input.Source.IgnoreTargetBranches = "^release/.*"
+	branch := getBranchFixture()
+	branch.Metadata.PullRequestMD.PullRequest = getPullRequestFixture()
+
+	branches, updatedBranches := processBranch([]string{}, []*common.ConcourseVersion{}, map[string]string{}, branch, input, NewCheckState(input))
+
+	if len(branches) != 1 {
+		t.Error("Expected branches to have length 1, got ", len(branches))
+	}
+	if len(updatedBranches) != 1 {
+		t.Error("Expected updatedBranches to have length 1, got ", len(updatedBranches))
+	} else if updatedBranches[0].PullRequestID != "42" || updatedBranches[0].TargetBranch != "master" {
+		t.Error("Expected version to carry pull request 42 into master, got ", updatedBranches[0])
+	}
+}
+
+func TestProcessStashBranches_TargetBranches_SeveralPullRequests(t *testing.T) {
+	_, input := getStashServerFixture(t, getValuesHandler(
+		`{"id":1,"state":"OPEN","toRef":{"displayId":"master"}}`,
+		`{"id":2,"state":"OPEN","toRef":{"displayId":"release/1.0"}}`,
+		`{"id":3,"state":"OPEN","toRef":{"displayId":"release/2.0"}}`,
+	))
+	input.Source.TargetBranches = "^release/.*"
+	branch := getBranchFixture()
+	branch.Metadata.PullRequestMD.Open = 3
+
+	branches, updatedBranches := ProcessStashBranches([]string{}, []*common.ConcourseVersion{}, map[string]string{}, []StashBranch{branch}, input, NewCheckState(input))
+
+	if len(branches) != 2 || branches[0] != "feature/my-branch#2::my-latest-commit-sha" || branches[1] != "feature/my-branch#3::my-latest-commit-sha" {
+		t.Error("Expected branches to hold an entry per pull request, got ", branches)
+	}
+	if len(updatedBranches) != 2 {
+		t.Error("Expected updatedBranches to have length 2, got ", len(updatedBranches))
+	} else if updatedBranches[0].PullRequestID != "2" || updatedBranches[1].PullRequestID != "3" {
+		t.Error("Expected versions of pull requests 2 and 3, got ", updatedBranches[0].PullRequestID, updatedBranches[1].PullRequestID)
+	}
+}
+
+func TestProcessStashBranches_TargetBranches_NewPullRequest(t *testing.T) {
+	_, input := getStashServerFixture(t, getValuesHandler(
+		`{"id":2,"state":"OPEN","toRef":{"displayId":"release/1.0"}}`,
+		`{"id":3,"state":"OPEN","toRef":{"displayId":"release/2.0"}}`,
+	))
+	input.Source.TargetBranches = "^release/.*"
+	branch := getBranchFixture()
+	branch.Metadata.PullRequestMD.Open = 2
+	branchToCommitMap := map[string]string{"feature/my-branch#2": "my-latest-commit-sha"}
+
+	branches, updatedBranches := ProcessStashBranches([]string{}, []*common.ConcourseVersion{}, branchToCommitMap, []StashBranch{branch}, input, NewCheckState(input))
+
+	if len(branches) != 2 {
+		t.Error("Expected branches to have length 2, got ", len(branches))
+	}
+	if len(updatedBranches) != 1 || updatedBranches[0].PullRequestID != "3" {
+		t.Error("Expected a version of the new pull request only, got ", updatedBranches)
+	}
+}
+
+func getAuthoredBranchFixture() StashBranch {
+	branch := getBranchFixture()
+	branch.Metadata.PullRequestMD.PullRequest.Author.User = common.StashUser{Name: "renovate-bot", EmailAddress: "renovate@company.com"}
+	branch.Metadata.LatestCommitMD.Author = common.StashUser{Name: "jdoe", EmailAddress: "jdoe@company.com"}
+
+	return branch
+}
+
+func TestProcessBranch_Filter_IgnoreAuthors_true(t *testing.T) {
+	input := getConcourseInputFixture()
+	input.Source.IgnoreAuthors = common.StringList{"release-bot", ".*-bot"}
+
+	branches, updatedBranches := processBranch([]string{}, []*common.ConcourseVersion{}, map[string]string{}, getAuthoredBranchFixture(), input, NewCheckState(input))
+
+	if len(branches) != 0 {
+		t.Error("Expected branches to have length 0, got ", len(branches))
+	}
+	if len(updatedBranches) != 0 {
+		t.Error("Expected updatedBranches to have length 0, got ", len(updatedBranches))
+	}
+}
+
+func TestProcessBranch_Filter_Authors_WholeMatch(t *testing.T) {
+	input := getConcourseInputFixture()
+	input.Source.Authors = common.StringList{"renovate"}
+
+	branches, _ := processBranch([]string{}, []*common.ConcourseVersion{}, map[string]string{}, getAuthoredBranchFixture(), input, NewCheckState(input))
+
+	if len(branches) != 0 {
+		t.Error("Expected branches to have length 0, got ", len(branches))
+	}
+}
+
+func TestProcessBranch_Filter_Authors_Email(t *testing.T) {
+	input := getConcourseInputFixture()
+	input.Source.Authors = common.StringList{"renovate@company.com"}
+
+	branches, _ := processBranch([]string{}, []*common.ConcourseVersion{}, map[string]string{}, getAuthoredBranchFixture(), input, NewCheckState(input))
+
+	if len(branches) != 1 {
+		t.Error("Expected branches to have length 1, got ", len(branches))
+	}
+}
+
+func TestProcessBranch_Filter_Authors_MatchCommitAuthor(t *testing.T) {
+	input := getConcourseInputFixture()
+	input.Source.Authors = common.StringList{"jdoe"}
+
+	branches, _ := processBranch([]string{}, []*common.ConcourseVersion{}, map[string]string{}, getAuthoredBranchFixture(), input, NewCheckState(input))
+
+	if len(branches) != 0 {
+		t.Error("Expected branches to have length 0 without match_commit_author, got ", len(branches))
+	}
+
+	input.Source.MatchCommitAuthor = true
+
+	branches, _ = processBranch([]string{}, []*common.ConcourseVersion{}, map[string]string{}, getAuthoredBranchFixture(), input, NewCheckState(input))
+
+	if len(branches) != 1 {
+		t.Error("Expected branches to have length 1 with match_commit_author, got ", len(branches))
+	}
+}
+
+func TestValidateInput_InvalidAuthor(t *testing.T) {
+	input := getConcourseInputFixture()
+	input.Source.IgnoreAuthors = common.StringList{"bot("}
+
+	err := ValidateInput(input)
+
+	if err == nil {
+		t.Error("Expected non-nil error, got nil")
+	}
+}
+
+func TestValidateInput_InvalidTargetBranches(t *testing.T) {
+	input := getConcourseInputFixture()
+	input.Source.IgnoreTargetBranches = "release/("
+
+	err := ValidateInput(input)
+
+	if err == nil {
+		t.Error("Expected non-nil error, got nil")
+	}
+}
+
+func TestProcessBranch_SkipWIP_Title(t *testing.T) {
+	input := getConcourseInputFixture()
+	input.Source.SkipWIP = true
+	branch := getBranchFixture()
+	branch.Metadata.PullRequestMD.PullRequest.Title = "[WIP] my feature"
+
+	branches, updatedBranches := processBranch([]string{}, []*common.ConcourseVersion{}, map[string]string{}, branch, input, NewCheckState(input))
+
+	if len(branches) != 1 || branches[0] != "feature/my-branch::my-latest-commit-sha::draft" {
+		t.Error("Expected branches to hold the draft entry, got ", branches)
+	}
+	if len(updatedBranches) != 0 {
+		t.Error("Expected updatedBranches to have length 0, got ", len(updatedBranches))
+	}
+}
+
+func TestProcessBranch_SkipWIP_Draft(t *testing.T) {
+	input := getConcourseInputFixture()
+	input.Source.SkipWIP = true
+	input.Source.WIPPattern = "^Do not merge"
+	branch := getBranchFixture()
+	branch.Metadata.PullRequestMD.PullRequest.Title = "WIP is not matched by the custom pattern"
+	branch.Metadata.PullRequestMD.PullRequest.Draft = true
+
+	_, updatedBranches := processBranch([]string{}, []*common.ConcourseVersion{}, map[string]string{}, branch, input, NewCheckState(input))
+
+	if len(updatedBranches) != 0 {
+		t.Error("Expected updatedBranches to have length 0, got ", len(updatedBranches))
+	}
+}
+
+func TestProcessBranch_SkipWIP_LeftDraft(t *testing.T) {
+	input := getConcourseInputFixture()
+	input.Source.SkipWIP = true
+	input.Version.Branches = []string{"feature/my-branch::my-latest-commit-sha::draft"}
+	branch := getBranchFixture()
+	branch.Metadata.PullRequestMD.PullRequest.Title = "my feature"
+
+	branches, updatedBranches := processBranch([]string{}, []*common.ConcourseVersion{}, GetBranchToCommitMap(input), branch, input, NewCheckState(input))
+
+	if len(branches) != 1 || branches[0] != "feature/my-branch::my-latest-commit-sha" {
+		t.Error("Expected branches to hold the entry without state, got ", branches)
+	}
+	if len(updatedBranches) != 1 {
+		t.Error("Expected updatedBranches to have length 1, got ", len(updatedBranches))
+	}
+}
+
+func TestGetBranchToCommitMap_State(t *testing.T) {
+	input := getConcourseInputFixture()
+	input.Version.Branches = []string{"feature/a::sha-a", "feature/b::sha-b::draft"}
+
+	branchToCommitMap := GetBranchToCommitMap(input)
+
+	if branchToCommitMap["feature/a"] != "sha-a" || branchToCommitMap["feature/b"] != "sha-b::draft" {
+		t.Error("Expected branches to map to their sha and state, got ", branchToCommitMap)
+	}
+}
+
+func getReviewedBranchFixture(approvers ...string) StashBranch {
+	branch := getBranchFixture()
+	branch.Metadata.PullRequestMD.PullRequest.Reviewers = []common.StashParticipant{
+		{User: common.StashUser{Name: "reviewer"}, Status: "UNAPPROVED"},
+	}
+	for _, approver := range approvers {
+		branch.Metadata.PullRequestMD.PullRequest.Reviewers = append(branch.Metadata.PullRequestMD.PullRequest.Reviewers,
+			common.StashParticipant{User: common.StashUser{Name: approver}, Approved: true, Status: "APPROVED"})
+	}
+
+	return branch
+}
+
+func TestProcessBranch_MinApprovals_Unapproved(t *testing.T) {
+	input := getConcourseInputFixture()
+	input.Source.MinApprovals = 2
+
+	branches, updatedBranches := processBranch([]string{}, []*common.ConcourseVersion{}, map[string]string{}, getReviewedBranchFixture("alice"), input, NewCheckState(input))
+
+	if len(branches) != 1 || branches[0] != "feature/my-branch::my-latest-commit-sha::unapproved" {
+		t.Error("Expected branches to hold the unapproved entry, got ", branches)
+	}
+	if len(updatedBranches) != 0 {
+		t.Error("Expected updatedBranches to have length 0, got ", len(updatedBranches))
+	}
+}
+
+func TestProcessBranch_MinApprovals_ReachedLater(t *testing.T) {
+	input := getConcourseInputFixture()
+	input.Source.MinApprovals = 2
+	input.Version.Branches = []string{"feature/my-branch::my-latest-commit-sha::unapproved"}
+
+	branches, updatedBranches := processBranch([]string{}, []*common.ConcourseVersion{}, GetBranchToCommitMap(input), getReviewedBranchFixture("alice", "bob"), input, NewCheckState(input))
+
+	if len(branches) != 1 || branches[0] != "feature/my-branch::my-latest-commit-sha" {
+		t.Error("Expected branches to hold the entry without state, got ", branches)
+	}
+	if len(updatedBranches) != 1 {
+		t.Error("Expected updatedBranches to have length 1, got ", len(updatedBranches))
+	}
+}
+
+func TestProcessBranch_RequiredReviewers(t *testing.T) {
+	input := getConcourseInputFixture()
+	input.Source.RequiredReviewers = common.StringList{"Carol"}
+
+	_, updatedBranches := processBranch([]string{}, []*common.ConcourseVersion{}, map[string]string{}, getReviewedBranchFixture("alice"), input, NewCheckState(input))
+
+	if len(updatedBranches) != 0 {
+		t.Error("Expected updatedBranches to have length 0 without carol's approval, got ", len(updatedBranches))
+	}
+
+	_, updatedBranches = processBranch([]string{}, []*common.ConcourseVersion{}, map[string]string{}, getReviewedBranchFixture("alice", "carol"), input, NewCheckState(input))
+
+	if len(updatedBranches) != 1 {
+		t.Error("Expected updatedBranches to have length 1 with carol's approval, got ", len(updatedBranches))
+	}
+}
+
+func TestProcessBranch_MinApprovalsOrRequiredReviewers(t *testing.T) {
+	input := getConcourseInputFixture()
+	input.Source.MinApprovals = 2
+	input.Source.RequiredReviewers = common.StringList{"carol"}
+
+	_, updatedBranches := processBranch([]string{}, []*common.ConcourseVersion{}, map[string]string{}, getReviewedBranchFixture("carol"), input, NewCheckState(input))
+
+	if len(updatedBranches) != 1 {
+		t.Error("Expected updatedBranches to have length 1 with a required reviewer's approval, got ", len(updatedBranches))
+	}
+
+	_, updatedBranches = processBranch([]string{}, []*common.ConcourseVersion{}, map[string]string{}, getReviewedBranchFixture("alice", "bob"), input, NewCheckState(input))
+
+	if len(updatedBranches) != 1 {
+		t.Error("Expected updatedBranches to have length 1 with min_approvals approvals, got ", len(updatedBranches))
+	}
+
+	_, updatedBranches = processBranch([]string{}, []*common.ConcourseVersion{}, map[string]string{}, getReviewedBranchFixture("alice"), input, NewCheckState(input))
+
+	if len(updatedBranches) != 0 {
+		t.Error("Expected updatedBranches to have length 0 with neither, got ", len(updatedBranches))
+	}
+}
+
+func TestProcessBranch_RequiredReviewers_Group(t *testing.T) {
+	_, input := getStashServerFixture(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("context") != "tech-leads" {
+			t.Error("Expected members of group tech-leads to be requested, got ", r.URL.Query().Get("context"))
+		}
+		getValuesHandler(`{"name":"dave"}`, `{"name":"erin"}`)(w, r)
+	})
+	input.Source.RequiredReviewers = common.StringList{"group:tech-leads"}
+
+	_, updatedBranches := processBranch([]string{}, []*common.ConcourseVersion{}, map[string]string{}, getReviewedBranchFixture("alice", "erin"), input, NewCheckState(input))
+
+	if len(updatedBranches) != 1 {
+		t.Error("Expected updatedBranches to have length 1, got ", len(updatedBranches))
+	}
+}
+
+func getActivitiesHandler() http.HandlerFunc {
+	comment := func(id int, text string, author string, createdDate int64) string {
+		return fmt.Sprintf(`{"action":"COMMENTED","commentAction":"ADDED","comment":{"id":%d,"text":%q,"author":{"name":%q},"createdDate":%d}}`,
+			id, text, author, createdDate)
+	}
+	now := time.Now().UnixNano() / 1000000
+
+	return getValuesHandler(
+		comment(9, "retest this please", "bob", now),
+		comment(8, "looks good", "alice", now-1000),
+		`{"action":"APPROVED"}`,
+		comment(7, "retest this please", "alice", now-2000),
+		comment(5, "retest this please", "alice", now-3000),
+	)
+}
+
+func TestProcessBranch_TriggerComment(t *testing.T) {
+	_, input := getStashServerFixture(t, getActivitiesHandler())
+	input.Source.TriggerComment = "^retest this please$"
+	input.Version.Branches = []string{"feature/my-branch::my-latest-commit-sha::comment-5"}
+
+	branches, updatedBranches := processBranch([]string{}, []*common.ConcourseVersion{}, GetBranchToCommitMap(input), getBranchFixture(), input, NewCheckState(input))
+
+	if len(branches) != 1 || branches[0] != "feature/my-branch::my-latest-commit-sha::comment-9" {
+		t.Error("Expected branches to hold the entry with the latest trigger comment, got ", branches)
+	}
+	if len(updatedBranches) != 2 {
+		t.Error("Expected updatedBranches to have length 2, got ", len(updatedBranches))
+	} else if updatedBranches[0].CommentID != "7" || updatedBranches[1].CommentID != "9" {
+		t.Error("Expected versions of comments 7 and 9, got ", updatedBranches[0].CommentID, updatedBranches[1].CommentID)
+	}
+}
+
+func TestProcessBranch_TriggerComment_Users(t *testing.T) {
+	_, input := getStashServerFixture(t, getActivitiesHandler())
+	input.Source.TriggerComment = "retest"
+	input.Source.TriggerCommentUsers = common.StringList{"bob"}
+	input.Version.Branches = []string{"feature/my-branch::my-latest-commit-sha::comment-5"}
+
+	_, updatedBranches := processBranch([]string{}, []*common.ConcourseVersion{}, GetBranchToCommitMap(input), getBranchFixture(), input, NewCheckState(input))
+
+	if len(updatedBranches) != 1 || updatedBranches[0].CommentID != "9" {
+		t.Error("Expected a single version of comment 9, got ", updatedBranches)
+	}
+}
+
+func TestProcessBranch_TriggerComment_NewCommit(t *testing.T) {
+	_, input := getStashServerFixture(t, getActivitiesHandler())
+	input.Source.TriggerComment = "retest"
+	input.Version.Branches = []string{"feature/my-branch::my-previous-commit-sha::comment-5"}
+
+	branches, updatedBranches := processBranch([]string{}, []*common.ConcourseVersion{}, GetBranchToCommitMap(input), getBranchFixture(), input, NewCheckState(input))
+
+	if len(updatedBranches) != 1 || updatedBranches[0].CommentID != "" {
+		t.Error("Expected a single version of the new commit, got ", updatedBranches)
+	}
+	if len(branches) != 1 || branches[0] != "feature/my-branch::my-latest-commit-sha::comment-9" {
+		t.Error("Expected branches to record the latest comment, got ", branches)
+	}
+}
+
+func TestProcessBranch_TriggerComment_NotRecorded(t *testing.T) {
+	_, input := getStashServerFixture(t, getActivitiesHandler())
+	input.Source.TriggerComment = "retest"
+	input.Version.Branches = []string{"feature/my-branch::my-latest-commit-sha"}
+
+	branches, updatedBranches := processBranch([]string{}, []*common.ConcourseVersion{}, GetBranchToCommitMap(input), getBranchFixture(), input, NewCheckState(input))
+
+	if len(updatedBranches) != 0 {
+		t.Error("Expected the comments to only be recorded, got ", updatedBranches)
+	}
+	if len(branches) != 1 || branches[0] != "feature/my-branch::my-latest-commit-sha::comment-9" {
+		t.Error("Expected branches to record the latest comment, got ", branches)
+	}
+}
+
+func TestProcessBranch_TriggerComment_NotUpdated(t *testing.T) {
+	_, input := getStashServerFixture(t, getUnexpectedRequestHandler(t))
+	input.Source.TriggerComment = "retest"
+	input.Version.Branches = []string{"feature/my-branch::my-latest-commit-sha::comment-5"}
+	input.Version.Watermark = "1000"
+	branch := getBranchFixture()
+	branch.Metadata.PullRequestMD.PullRequest.UpdatedDate = 900
+
+	branches, updatedBranches := processBranch([]string{}, []*common.ConcourseVersion{}, GetBranchToCommitMap(input), branch, input, NewCheckState(input))
+
+	if len(updatedBranches) != 0 {
+		t.Error("Expected updatedBranches to have length 0, got ", len(updatedBranches))
+	}
+	if len(branches) != 1 || branches[0] != "feature/my-branch::my-latest-commit-sha::comment-5" {
+		t.Error("Expected branches to keep the recorded comment, got ", branches)
+	}
+}
+
+func getForkBranchFixture() StashBranch {
+	pullRequest := getPullRequestFixture()
+	pullRequest.FromRef.Repository = common.StashRepository{Slug: "my_repo", Project: common.StashProject{Key: "~JDOE"}}
+	pullRequest.ToRef.Repository = common.StashRepository{Slug: "my_repo", Project: common.StashProject{Key: "MY_PROJECT"}}
+
+	return pullRequestBranch(pullRequest, common.StashCommit{AuthorTimestamp: time.Now().UnixNano() / 1000000})
+}
+
+func TestProcessBranch_Fork(t *testing.T) {
+	input := getConcourseInputFixture()
+	input.Source.ForkTrustedReviewers = common.StringList{"alice"}
+	branch := getForkBranchFixture()
+	branch.Metadata.PullRequestMD.PullRequest.Reviewers = []common.StashParticipant{
+		{User: common.StashUser{Name: "alice"}, Approved: true, LastReviewedCommit: "my-latest-commit-sha"}}
+
+	branches, updatedBranches := processBranch([]string{}, []*common.ConcourseVersion{}, map[string]string{}, branch, input, NewCheckState(input))
+
+	if len(branches) != 1 || branches[0] != "~JDOE/my_repo/feature/my-branch::my-latest-commit-sha" {
+		t.Error("Expected branches to hold the entry prefixed with the fork, got ", branches)
+	}
+	if len(updatedBranches) != 1 {
+		t.Error("Expected updatedBranches to have length 1, got ", len(updatedBranches))
+	} else if updatedBranches[0].PullRequestID != "42" || updatedBranches[0].SourceProject != "~JDOE" || updatedBranches[0].SourceRepo != "my_repo" {
+		t.Error("Expected version to carry the pull request and the fork, got ", updatedBranches[0])
+	}
+}
+
+func TestValidateInput_ForksWithoutTrustedReviewers(t *testing.T) {
+	input := getConcourseInputFixture()
+	input.Source.Forks = true
+
+	if err := ValidateInput(input); err == nil {
+		t.Error("Expected non-nil error, got nil")
+	}
+
+	input.Source.ForkTrustedReviewers = common.StringList{"alice"}
+
+	if err := ValidateInput(input); err != nil {
+		t.Error("Expected nil error, got ", err)
+	}
+}
+
+func TestProcessBranch_Fork_TrustedReviewers(t *testing.T) {
+	input := getConcourseInputFixture()
+	input.Source.ForkTrustedReviewers = common.StringList{"alice"}
+	branch := getForkBranchFixture()
+
+	_, updatedBranches := processBranch([]string{}, []*common.ConcourseVersion{}, map[string]string{}, branch, input, NewCheckState(input))
+
+	if len(updatedBranches) != 0 {
+		t.Error("Expected updatedBranches to have length 0 without a trusted approval, got ", len(updatedBranches))
+	}
+
+	branch.Metadata.PullRequestMD.PullRequest.Reviewers = []common.StashParticipant{
+		{User: common.StashUser{Name: "alice"}, Approved: true, LastReviewedCommit: "my-latest-commit-sha"}}
+
+	_, updatedBranches = processBranch([]string{}, []*common.ConcourseVersion{}, map[string]string{}, branch, input, NewCheckState(input))
+
+	if len(updatedBranches) != 1 {
+		t.Error("Expected updatedBranches to have length 1 with a trusted approval, got ", len(updatedBranches))
+	}
+}
+
+func TestProcessBranch_Fork_ApprovedEarlierCommit(t *testing.T) {
+	input := getConcourseInputFixture()
+	input.Source.ForkTrustedReviewers = common.StringList{"alice"}
+	branch := getForkBranchFixture()
+	branch.Metadata.PullRequestMD.PullRequest.Reviewers = []common.StashParticipant{
+		{User: common.StashUser{Name: "alice"}, Approved: true, LastReviewedCommit: "my-latest-commit-sha"}}
+	branch.Metadata.PullRequestMD.PullRequest.FromRef.LatestCommit = "my-pushed-sha"
+	branch.LatestCommit = "my-pushed-sha"
+	branchToCommitMap := map[string]string{"~JDOE/my_repo/feature/my-branch": "my-latest-commit-sha"}
+
+	branches, updatedBranches := processBranch([]string{}, []*common.ConcourseVersion{}, branchToCommitMap, branch, input, NewCheckState(input))
+
+	if len(branches) != 1 || branches[0] != "~JDOE/my_repo/feature/my-branch::my-pushed-sha::unapproved" {
+		t.Error("Expected branches to hold the unapproved entry, got ", branches)
+	}
+	if len(updatedBranches) != 0 {
+		t.Error("Expected updatedBranches to have length 0, got ", len(updatedBranches))
+	}
+}
+
+func TestGetStashPullRequestBranches_Forks(t *testing.T) {
+	_, input := getStashServerFixture(t, func(w http.ResponseWriter, r *http.Request) {
+		repo := `{"slug":"my_repo","project":{"key":"MY_PROJECT"}}`
+		fork := `{"slug":"my_repo","project":{"key":"~JDOE"}}`
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/pull-requests"):
+			fmt.Fprintf(w, `{"values":[`+
+				`{"id":1,"state":"OPEN","fromRef":{"displayId":"a","latestCommit":"sha-a","repository":%s},"toRef":{"displayId":"master","repository":%s}},`+
+				`{"id":2,"state":"OPEN","fromRef":{"displayId":"b","latestCommit":"sha-b","repository":%s},"toRef":{"displayId":"master","repository":%s}}`+
+				`],"isLastPage":true}`, repo, repo, fork, repo)
+		case strings.HasSuffix(r.URL.Path, "/pull-requests/2/commits"):
+			getValuesHandler(`{"id":"sha-b","message":"fork commit"}`)(w, r)
+		default:
+			fmt.Fprint(w, `{"id":"sha-a","message":"repo commit"}`)
+		}
+	})
+
+	if branches := GetStashPullRequestBranches(input); len(branches) != 1 {
+		t.Error("Expected branches to have length 1 without forks, got ", len(branches))
+	}
+
+	input.Source.Forks = true
+
+	branches := GetStashPullRequestBranches(input)
+	if len(branches) != 2 {
+		t.Error("Expected branches to have length 2 with forks, got ", len(branches))
+	} else if branch := withLatestCommit(branches[1], input); branch.Metadata.LatestCommitMD.Message != "fork commit" {
+		t.Error("Expected the fork commit to be read from its pull request, got ", branch.Metadata.LatestCommitMD.Message)
+	}
+
+	if forkBranches := GetStashForkPullRequestBranches(input); len(forkBranches) != 1 || forkBranches[0].DisplayID != "b" {
+		t.Error("Expected only the fork branch, got ", forkBranches)
+	}
+}
+
+func TestRepoInputs_RepoPattern(t *testing.T) {
+	_, input := getStashServerFixture(t, func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/projects/my_project/repos") {
+			t.Error("Expected the repos of the project to be requested, got ", r.URL.Path)
+		}
+		getValuesHandler(`{"slug":"users-service"}`, `{"slug":"docs"}`, `{"slug":"orders-service"}`)(w, r)
+	})
+	input.Source.RepoName = ""
+	input.Source.RepoPattern = "-service$"
+
+	repoInputs := RepoInputs(input)
+
+	if len(repoInputs) != 2 || repoInputs[0].Source.RepoName != "users-service" || repoInputs[1].Source.RepoName != "orders-service" {
+		t.Error("Expected inputs of the users-service and orders-service repos, got ", repoInputs)
+	}
+}
+
+func TestProcessBranch_Repos(t *testing.T) {
+	input := getConcourseInputFixture()
+	input.Source.Repos = common.StringList{"users-service", "orders-service"}
+	repoInput := RepoInputs(input)[1]
+
+	branches, updatedBranches := processBranch([]string{}, []*common.ConcourseVersion{}, map[string]string{}, getBranchFixture(), repoInput, NewCheckState(repoInput))
+
+	if len(branches) != 1 || branches[0] != "orders-service/feature/my-branch::my-latest-commit-sha" {
+		t.Error("Expected branches to hold the entry prefixed with the repo, got ", branches)
+	}
+	if len(updatedBranches) != 1 || updatedBranches[0].Repo != "orders-service" {
+		t.Error("Expected a version of the orders-service repo, got ", updatedBranches)
+	}
+}
+
+func TestValidateInput_ReposWithRepoName(t *testing.T) {
+	input := getConcourseInputFixture()
+	input.Source.RepoName = "my_repo"
+	input.Source.Repos = common.StringList{"users-service"}
+
+	err := ValidateInput(input)
+
+	if err == nil {
+		t.Error("Expected non-nil error, got nil")
+	}
+}
+
+func TestSkipBuiltCommits(t *testing.T) {
+	statusesRequested := []string{}
+	_, input := getStashServerFixture(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/rest/build-status/1.0/commits/stats"):
+			fmt.Fprint(w, `{"sha-built":{"successful":1},"sha-other-key":{"successful":1},"sha-failed":{"failed":1}}`)
+		case strings.HasSuffix(r.URL.Path, "/commits/sha-built"):
+			statusesRequested = append(statusesRequested, "sha-built")
+			getValuesHandler(`{"state":"SUCCESSFUL","key":"my-pipeline"}`)(w, r)
+		case strings.HasSuffix(r.URL.Path, "/commits/sha-other-key"):
+			statusesRequested = append(statusesRequested, "sha-other-key")
+			getValuesHandler(`{"state":"SUCCESSFUL","key":"other-pipeline"}`)(w, r)
+		default:
+			getUnexpectedRequestHandler(t)(w, r)
+		}
+	})
+	input.Source.SkipBuiltStatusKey = "my-pipeline"
+
+	previousVersion := &common.ConcourseVersion{Ref: "sha-built", Branches: []string{"feature/a::sha-built"}}
+	updatedBranches := []*common.ConcourseVersion{
+		previousVersion,
+		{Ref: "sha-built"},
+		{Ref: "sha-other-key"},
+		{Ref: "sha-failed"},
+		{Ref: "sha-built", CommentID: "7"},
+	}
+
+	updatedBranches = SkipBuiltCommits(updatedBranches, input)
+
+	if len(updatedBranches) != 4 || updatedBranches[0] != previousVersion || updatedBranches[1].Ref != "sha-other-key" ||
+		updatedBranches[2].Ref != "sha-failed" || updatedBranches[3].CommentID != "7" {
+		t.Error("Expected only the new version of sha-built to be skipped, got ", updatedBranches)
+	}
+	if len(statusesRequested) != 2 {
+		t.Error("Expected the statuses of the 2 commits with a successful build to be requested, got ", statusesRequested)
+	}
+}
+
+func getCommitsHandler(t *testing.T, commits ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/commits") || r.URL.Query().Get("until") != "my-latest-commit-sha" ||
+			r.URL.Query().Get("since") != "my-previous-sha" {
+			t.Error("Unexpected request ", r.URL.String())
+		}
+
+		getPagedValuesHandler(len(commits), 0, func(i int) string {
+			return fmt.Sprintf(`{"id":"%s"}`, commits[i])
+		})(w, r)
+	}
+}
+
+func TestProcessBranch_EveryCommit(t *testing.T) {
+	_, input := getStashServerFixture(t, getCommitsHandler(t, "my-latest-commit-sha", "my-second-sha", "my-first-sha"))
+	input.Source.EveryCommit = true
+	branchToCommitMap := map[string]string{"feature/my-branch": "my-previous-sha"}
+
+	_, updatedBranches := processBranch([]string{}, []*common.ConcourseVersion{}, branchToCommitMap, getBranchFixture(), input, NewCheckState(input))
+
+	if len(updatedBranches) != 3 || updatedBranches[0].Ref != "my-first-sha" || updatedBranches[1].Ref != "my-second-sha" ||
+		updatedBranches[2].Ref != "my-latest-commit-sha" {
+		t.Error("Expected a version per pushed commit, oldest first, got ", updatedBranches)
+	}
+	for _, updatedBranch := range updatedBranches {
+		if updatedBranch.ChangedBranch != "feature/my-branch" {
+			t.Error("Expected the versions to be on feature/my-branch, got ", updatedBranch.ChangedBranch)
+		}
+	}
+}
+
+func TestProcessBranch_EveryCommit_MaxCommits(t *testing.T) {
+	_, input := getStashServerFixture(t, getCommitsHandler(t, "my-latest-commit-sha", "my-second-sha", "my-first-sha"))
+	input.Source.EveryCommit = true
+	input.Source.MaxCommits = 2
+	branchToCommitMap := map[string]string{"feature/my-branch": "my-previous-sha"}
+
+	_, updatedBranches := processBranch([]string{}, []*common.ConcourseVersion{}, branchToCommitMap, getBranchFixture(), input, NewCheckState(input))
+
+	if len(updatedBranches) != 2 || updatedBranches[0].Ref != "my-second-sha" || updatedBranches[1].Ref != "my-latest-commit-sha" {
+		t.Error("Expected a version for the 2 latest commits, got ", updatedBranches)
+	}
+}
+
+func TestProcessBranch_EveryCommit_NewBranch(t *testing.T) {
+	_, input := getStashServerFixture(t, getUnexpectedRequestHandler(t))
+	input.Source.EveryCommit = true
+
+	_, updatedBranches := processBranch([]string{}, []*common.ConcourseVersion{}, map[string]string{}, getBranchFixture(), input, NewCheckState(input))
+
+	if len(updatedBranches) != 1 || updatedBranches[0].Ref != "my-latest-commit-sha" {
+		t.Error("Expected a version of the latest commit only, got ", updatedBranches)
+	}
+}
+
+func TestProcessBranch_EveryCommit_Rewritten(t *testing.T) {
+	_, input := getStashServerFixture(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"errors":[{"message":"Commit 'my-previous-sha' does not exist in repository 'my_repo'."}]}`)
+	})
+	input.Source.EveryCommit = true
+	branchToCommitMap := map[string]string{"feature/my-branch": "my-previous-sha"}
+
+	_, updatedBranches := processBranch([]string{}, []*common.ConcourseVersion{}, branchToCommitMap, getBranchFixture(), input, NewCheckState(input))
+
+	if len(updatedBranches) != 1 || updatedBranches[0].Ref != "my-latest-commit-sha" {
+		t.Error("Expected a version of the latest commit only, got ", updatedBranches)
+	}
+}
+
+func TestProcessBranch_EveryCommit_SkippedCommits(t *testing.T) {
+	_, input := getStashServerFixture(t, getValuesHandler(`{"id":"my-latest-commit-sha","message":"Bump version [ci skip]"}`,
+		`{"id":"my-second-sha","message":"Skipped [skip ci]"}`, `{"id":"my-first-sha","message":"Fix"}`))
+	input.Source.EveryCommit = true
+	branch := getBranchFixture()
+	branch.Metadata.LatestCommitMD.Message = "Bump version [ci skip]"
+	branchToCommitMap := map[string]string{"feature/my-branch": "my-previous-sha"}
+
+	branches, updatedBranches := processBranch([]string{}, []*common.ConcourseVersion{}, branchToCommitMap, branch, input, NewCheckState(input))
+
+	if len(updatedBranches) != 1 || updatedBranches[0].Ref != "my-first-sha" {
+		t.Error("Expected a version of the commit not marked as skip only, got ", updatedBranches)
+	}
+	if len(branches) != 1 || branches[0] != "feature/my-branch::my-latest-commit-sha" {
+		t.Error("Expected branches to hold the latest commit, got ", branches)
+	}
+}
+
+func TestProcessBranch_EveryCommit_FilteredOut(t *testing.T) {
+	input := getConcourseInputFixture()
+	input.Source.EveryCommit = true
+	input.Source.Branches = "release/.*"
+	branchToCommitMap := map[string]string{"feature/my-branch": "my-previous-sha"}
+
+	branches, updatedBranches := processBranch([]string{}, []*common.ConcourseVersion{}, branchToCommitMap, getBranchFixture(), input, NewCheckState(input))
+
+	if len(branches) != 1 || branches[0] != "feature/my-branch::my-previous-sha" {
+		t.Error("Expected branches to keep the previous entry, got ", branches)
+	}
+	if len(updatedBranches) != 0 {
+		t.Error("Expected updatedBranches to have length 0, got ", len(updatedBranches))
+	}
+}
+
+func TestProcessBranch_EveryCommit_HeldBack(t *testing.T) {
+	input := getConcourseInputFixture()
+	input.Source.EveryCommit = true
+	input.Source.SkipWIP = true
+	branch := getBranchFixture()
+	branch.Metadata.PullRequestMD.PullRequest.Draft = true
+	branchToCommitMap := map[string]string{"feature/my-branch": "my-previous-sha"}
+
+	branches, _ := processBranch([]string{}, []*common.ConcourseVersion{}, branchToCommitMap, branch, input, NewCheckState(input))
+
+	if len(branches) != 1 || branches[0] != "feature/my-branch::my-previous-sha::draft" {
+		t.Error("Expected branches to hold the previous sha in the draft entry, got ", branches)
+	}
+}
+
+func TestValidateInput_EveryCommitCompactVersions(t *testing.T) {
+	input := getConcourseInputFixture()
+	input.Source.Mode = common.ModePullRequests
+	input.Source.EveryCommit = true
+	input.Source.CompactVersions = true
+
+	err := ValidateInput(input)
+
+	if err == nil {
+		t.Error("Expected non-nil error, got nil")
+	}
+}
+
+func TestProcessBranch_LatestCommitPending(t *testing.T) {
+	commitsRequested := 0
+	_, input := getStashServerFixture(t, func(w http.ResponseWriter, r *http.Request) {
+		commitsRequested++
+		fmt.Fprint(w, `{"id":"my-latest-commit-sha","message":"my commit [ci skip]"}`)
+	})
+	input.Source.Mode = common.ModePullRequests
+	branch := pullRequestBranch(getPullRequestFixture(), common.StashCommit{})
+	branch.latestCommitPending = true
+
+	branches, _ := processBranch([]string{}, []*common.ConcourseVersion{}, map[string]string{"42": "my-latest-commit-sha"}, branch, input, NewCheckState(input))
+
+	if commitsRequested != 0 || len(branches) != 1 {
+		t.Error("Expected the commit seen by the previous version not to be requested, got ", commitsRequested, branches)
+	}
+
+	_, updatedBranches := processBranch([]string{}, []*common.ConcourseVersion{}, map[string]string{"42": "my-previous-sha"}, branch, input, NewCheckState(input))
+
+	if commitsRequested != 1 || len(updatedBranches) != 0 {
+		t.Error("Expected the new commit to be requested and skipped, got ", commitsRequested, updatedBranches)
+	}
+}
@@ -0,0 +1,159 @@
+package checklib
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strconv"
+	"strings"
+
+	"../common"
+)
+
+// compactChanges returns true if the changes are read from the activities since the watermark of the previous compact version
+func compactChanges(input common.ConcourseInput) bool {
+	return input.Source.CompactVersions && input.Version.Snapshot != ""
+}
+
+// watermarked returns true if the versions hold the watermark of the check
+func watermarked(input common.ConcourseInput) bool {
+	return input.Source.CompactVersions || input.Source.TriggerComment != ""
+}
+
+func previousWatermark(input common.ConcourseInput) int64 {
+	watermark, _ := strconv.ParseInt(input.Version.Watermark, 10, 64)
+	return watermark
+}
+
+// observeListedPullRequests raises the watermark of the check to the latest update of the listed pull requests, ignoring later activities
+func observeListedPullRequests(stashBranches []StashBranch, state *CheckState) {
+	for _, branch := range stashBranches {
+		if updatedDate := branch.Metadata.PullRequestMD.PullRequest.UpdatedDate; updatedDate > state.watermark {
+			state.watermark = updatedDate
+		}
+	}
+}
+
+// appendCompactUpdates appends the versions of the pull request of the branch for its updates since the previous watermark
+func appendCompactUpdates(updatedBranches []*common.ConcourseVersion, branch StashBranch, input common.ConcourseInput, state *CheckState) []*common.ConcourseVersion {
+	pullRequest := branch.Metadata.PullRequestMD.PullRequest
+	watermark := previousWatermark(input)
+
+	// approvals may not update the pull request, its activities are then always scanned
+	if pullRequest.UpdatedDate <= watermark && !approvalsRequired(input) {
+		return updatedBranches
+	}
+
+	recentActivities, err := common.GetStashPullRequestActivitiesSince(input.Source, pullRequest.ID, watermark)
+	common.HandleFatalError(err, "Error getting stash pull request activities")
+
+	updated := false
+	recentApprovers := map[string]bool{}
+	for _, activity := range recentActivities {
+		switch activity.Action {
+		case "OPENED", "REOPENED", "RESCOPED":
+			updated = true
+		case "APPROVED":
+			recentApprovers[activity.User.Name] = true
+		case "UPDATED":
+			if input.Source.SkipWIP && activity.PreviousTitle != "" && wipTitle(activity.PreviousTitle, input) {
+				updated = true
+			}
+		}
+	}
+
+	// an approval only triggers a version when the pull request was held back without it
+	if !updated && len(recentApprovers) > 0 {
+		previousBranch := branch
+		previousBranch.Metadata.PullRequestMD.PullRequest = withoutApprovals(pullRequest, recentApprovers)
+		updated = unapproved(previousBranch, input, state) || untrustedFork(previousBranch, input, state)
+	}
+
+	commentIDs := matchingTriggerComments(recentActivities, 0, input, state)
+	if !updated && len(commentIDs) == 0 {
+		return updatedBranches
+	}
+
+	// the latest commit of a pull request which wasn't updated is only read once it would be built
+	if branch = withLatestCommit(branch, input); commitMarkedAsSkip(branch) {
+		return updatedBranches
+	}
+
+	if updated {
+		updatedBranches = append(updatedBranches, newVersion(branch, input))
+	}
+
+	for _, commentID := range commentIDs {
+		version := newVersion(branch, input)
+		version.CommentID = strconv.Itoa(commentID)
+		updatedBranches = append(updatedBranches, version)
+	}
+
+	return updatedBranches
+}
+
+func approvalsRequired(input common.ConcourseInput) bool {
+	return input.Source.MinApprovals > 0 || len(input.Source.RequiredReviewers) > 0 || len(input.Source.ForkTrustedReviewers) > 0
+}
+
+// withoutApprovals returns a copy of the pull request in which the given users didn't approve it
+func withoutApprovals(pullRequest StashBranchPullRequest, approvers map[string]bool) StashBranchPullRequest {
+	withoutApprovals := func(participants []common.StashParticipant) []common.StashParticipant {
+		copied := []common.StashParticipant{}
+		for _, participant := range participants {
+			if approvers[participant.User.Name] {
+				participant.Approved = false
+				participant.Status = "UNAPPROVED"
+			}
+			copied = append(copied, participant)
+		}
+		return copied
+	}
+
+	pullRequest.Reviewers = withoutApprovals(pullRequest.Reviewers)
+	pullRequest.Participants = withoutApprovals(pullRequest.Participants)
+
+	return pullRequest
+}
+
+// SnapshotHash returns the hash of the flattened list of branches and sha's, which doesn't depend on its order
+func SnapshotHash(branches []string) string {
+	sorted := append([]string{}, branches...)
+	sort.Strings(sorted)
+
+	hash := sha256.Sum256([]byte(strings.Join(sorted, ",")))
+	return hex.EncodeToString(hash[:16])
+}
+
+// SetWatermarkNode returns the updated branches, the new ones holding the watermark of the check when the source needs it
+func SetWatermarkNode(updatedBranches []*common.ConcourseVersion, input common.ConcourseInput, state *CheckState) []*common.ConcourseVersion {
+	if !watermarked(input) {
+		return updatedBranches
+	}
+
+	for _, updatedBranch := range updatedBranches {
+		if pendingVersion(updatedBranch) {
+			updatedBranch.Watermark = strconv.FormatInt(state.watermark, 10)
+		}
+	}
+
+	return updatedBranches
+}
+
+// SetCompactNode returns the updated branches, the new ones holding the snapshot hash and watermark instead of the branches
+func SetCompactNode(updatedBranches []*common.ConcourseVersion, branches []string, input common.ConcourseInput, state *CheckState) []*common.ConcourseVersion {
+	updatedBranches = SetWatermarkNode(updatedBranches, input, state)
+
+	for _, updatedBranch := range updatedBranches {
+		if pendingVersion(updatedBranch) {
+			updatedBranch.Snapshot = SnapshotHash(branches)
+		}
+	}
+
+	return updatedBranches
+}
+
+// pendingVersion returns true if the version was emitted by the check, and doesn't hold the list of branches or snapshot yet
+func pendingVersion(version *common.ConcourseVersion) bool {
+	return len(version.Branches) == 0 && version.Snapshot == ""
+}
@@ -0,0 +1,158 @@
+package checklib
+
+import (
+	"net/http"
+	"testing"
+
+	"../common"
+)
+
+func getCompactInputFixture(t *testing.T, activities string) common.ConcourseInput {
+	_, input := getStashServerFixture(t, getValuesHandler(activities))
+	input.Source.Mode = common.ModePullRequests
+	input.Source.CompactVersions = true
+	input.Version = common.ConcourseVersion{ChangedBranch: "feature/other", Ref: "other-sha", Snapshot: "previous-snapshot", Watermark: "1000"}
+
+	return input
+}
+
+func getCompactBranchFixture(updatedDate int64) StashBranch {
+	pullRequest := getPullRequestFixture()
+	pullRequest.UpdatedDate = updatedDate
+
+	return pullRequestBranch(pullRequest, common.StashCommit{})
+}
+
+func TestSnapshotHash_Order(t *testing.T) {
+	if SnapshotHash([]string{"1::sha-a", "2::sha-b"}) != SnapshotHash([]string{"2::sha-b", "1::sha-a"}) {
+		t.Error("Expected the hash not to depend on the order of the branches")
+	}
+	if SnapshotHash([]string{"1::sha-a"}) == SnapshotHash([]string{"1::sha-b"}) {
+		t.Error("Expected the hash to depend on the sha's")
+	}
+}
+
+func TestProcessBranch_Compact_Rescoped(t *testing.T) {
+	input := getCompactInputFixture(t, `{"action":"COMMENTED","createdDate":2500},{"action":"RESCOPED","createdDate":2000},{"action":"OPENED","createdDate":500}`)
+
+	branches, updatedBranches := processBranch([]string{}, []*common.ConcourseVersion{}, GetBranchToCommitMap(input), getCompactBranchFixture(2000), input, NewCheckState(input))
+
+	if len(branches) != 1 || branches[0] != "42::my-latest-commit-sha" {
+		t.Error("Expected branches to hold the pull request entry, got ", branches)
+	}
+	if len(updatedBranches) != 1 || updatedBranches[0].PullRequestID != "42" {
+		t.Error("Expected a version of the rescoped pull request, got ", updatedBranches)
+	}
+}
+
+func TestProcessStashBranches_CompactWatermark(t *testing.T) {
+	input := getCompactInputFixture(t, `{"action":"RESCOPED","createdDate":2500}`)
+	state := NewCheckState(input)
+
+	ProcessStashBranches([]string{}, []*common.ConcourseVersion{}, GetBranchToCommitMap(input), []StashBranch{getCompactBranchFixture(2000)}, input, state)
+
+	if state.watermark != 2000 {
+		t.Error("Expected the watermark to be the latest update of the listed pull requests, got ", state.watermark)
+	}
+}
+
+func TestProcessBranch_Compact_NotUpdated(t *testing.T) {
+	input := getCompactInputFixture(t, `{"action":"OPENED","createdDate":500}`)
+	input.Source.StashUrl = "not-queried.invalid"
+
+	branches, updatedBranches := processBranch([]string{}, []*common.ConcourseVersion{}, GetBranchToCommitMap(input), getCompactBranchFixture(900), input, NewCheckState(input))
+
+	if len(branches) != 1 {
+		t.Error("Expected branches to have length 1, got ", len(branches))
+	}
+	if len(updatedBranches) != 0 {
+		t.Error("Expected updatedBranches to have length 0, got ", len(updatedBranches))
+	}
+}
+
+func TestProcessBranch_Compact_TitleUpdated(t *testing.T) {
+	input := getCompactInputFixture(t, `{"action":"UPDATED","createdDate":2000,"previousTitle":"WIP: my feature"},{"action":"UPDATED","createdDate":1500,"previousTitle":"my feature"}`)
+	input.Source.SkipWIP = true
+
+	_, updatedBranches := processBranch([]string{}, []*common.ConcourseVersion{}, GetBranchToCommitMap(input), getCompactBranchFixture(2000), input, NewCheckState(input))
+
+	if len(updatedBranches) != 1 {
+		t.Error("Expected a version of the pull request which left the work in progress state, got ", updatedBranches)
+	}
+}
+
+func TestProcessBranch_Compact_Approved(t *testing.T) {
+	input := getCompactInputFixture(t, `{"action":"APPROVED","createdDate":2000,"user":{"name":"bob"}}`)
+	input.Source.MinApprovals = 1
+	branch := getCompactBranchFixture(900)
+	branch.Metadata.PullRequestMD.PullRequest.Reviewers = []common.StashParticipant{{User: common.StashUser{Name: "bob"}, Approved: true}}
+
+	_, updatedBranches := processBranch([]string{}, []*common.ConcourseVersion{}, GetBranchToCommitMap(input), branch, input, NewCheckState(input))
+
+	if len(updatedBranches) != 1 {
+		t.Error("Expected a version of the pull request which got its approval, got ", updatedBranches)
+	}
+
+	branch.Metadata.PullRequestMD.PullRequest.Reviewers = append(branch.Metadata.PullRequestMD.PullRequest.Reviewers,
+		common.StashParticipant{User: common.StashUser{Name: "alice"}, Approved: true})
+
+	_, updatedBranches = processBranch([]string{}, []*common.ConcourseVersion{}, GetBranchToCommitMap(input), branch, input, NewCheckState(input))
+
+	if len(updatedBranches) != 0 {
+		t.Error("Expected no version of the pull request which was already approved, got ", updatedBranches)
+	}
+}
+
+func TestSetCompactNode(t *testing.T) {
+	input := getCompactInputFixture(t, "")
+	state := NewCheckState(input)
+	state.watermark = 3000
+	previousVersion := &input.Version
+	updatedBranches := []*common.ConcourseVersion{previousVersion, {Ref: "my-latest-commit-sha"}}
+
+	updatedBranches = SetCompactNode(updatedBranches, []string{"42::my-latest-commit-sha"}, input, state)
+
+	if updatedBranches[0].Snapshot != "previous-snapshot" || updatedBranches[0].Watermark != "1000" {
+		t.Error("Expected the previous version to be unchanged, got ", updatedBranches[0])
+	}
+	if updatedBranches[1].Snapshot != SnapshotHash([]string{"42::my-latest-commit-sha"}) || updatedBranches[1].Watermark != "3000" {
+		t.Error("Expected the new version to hold the snapshot and watermark of the check, got ", updatedBranches[1])
+	}
+	if len(updatedBranches[1].Branches) != 0 {
+		t.Error("Expected the new version not to hold the branches, got ", updatedBranches[1].Branches)
+	}
+}
+
+func TestValidateInput_CompactVersionsBranchesMode(t *testing.T) {
+	input := getConcourseInputFixture()
+	input.Source.CompactVersions = true
+
+	err := ValidateInput(input)
+
+	if err == nil {
+		t.Error("Expected non-nil error, got nil")
+	}
+}
+
+func TestProcessBranch_Compact_RescopedOnLaterPage(t *testing.T) {
+	pagesRequested := 0
+	activities := []string{`{"action":"COMMENTED","createdDate":3000}`, `{"action":"COMMENTED","createdDate":2500}`,
+		`{"action":"RESCOPED","createdDate":2000}`, `{"action":"OPENED","createdDate":500}`, `{"action":"OPENED","createdDate":400}`}
+	pagedHandler := getPagedValuesHandler(len(activities), 2, func(i int) string { return activities[i] })
+	_, input := getStashServerFixture(t, func(w http.ResponseWriter, r *http.Request) {
+		pagesRequested++
+		pagedHandler(w, r)
+	})
+	input.Source.Mode = common.ModePullRequests
+	input.Source.CompactVersions = true
+	input.Version = common.ConcourseVersion{Snapshot: "previous-snapshot", Watermark: "1000"}
+
+	_, updatedBranches := processBranch([]string{}, []*common.ConcourseVersion{}, GetBranchToCommitMap(input), getCompactBranchFixture(3000), input, NewCheckState(input))
+
+	if len(updatedBranches) != 1 {
+		t.Error("Expected a version of the pull request rescoped on a later page, got ", updatedBranches)
+	}
+	if pagesRequested != 2 {
+		t.Error("Expected the pages to be followed until the watermark, got ", pagesRequested)
+	}
+}
@@ -0,0 +1,164 @@
+package checklib
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"../common"
+)
+
+// PathMatcher matches repo paths against gitignore-like patterns, the last matching one wins
+type PathMatcher struct {
+	rules            []pathRule
+	includeByDefault bool
+}
+
+type pathRule struct {
+	pattern  string
+	segments []string
+	negated  bool
+	anyDepth bool
+}
+
+// SourcePathPatterns returns the patterns of the paths of the source, followed by its ignore_paths as negated patterns
+func SourcePathPatterns(source common.ConcourseSource) []string {
+	patterns := append([]string{}, source.Paths...)
+
+	for _, ignorePath := range source.IgnorePaths {
+		if strings.HasPrefix(ignorePath, "!") {
+			patterns = append(patterns, strings.TrimPrefix(ignorePath, "!"))
+		} else {
+			patterns = append(patterns, "!"+ignorePath)
+		}
+	}
+
+	return patterns
+}
+
+// NewPathMatcher returns a PathMatcher for the given patterns, an error if one of them is invalid
+func NewPathMatcher(patterns []string) (*PathMatcher, error) {
+	matcher := &PathMatcher{
+		includeByDefault: len(patterns) == 0 || strings.HasPrefix(patterns[0], "!"),
+	}
+
+	for _, pattern := range patterns {
+		rule := pathRule{}
+		if strings.HasPrefix(pattern, "!") {
+			rule.negated = true
+			pattern = strings.TrimPrefix(pattern, "!")
+		}
+
+		rule.pattern = strings.Trim(pattern, "/")
+		if rule.pattern == "" {
+			return nil, fmt.Errorf("Invalid path pattern '%s'", pattern)
+		}
+
+		rule.segments = strings.Split(rule.pattern, "/")
+		for _, segment := range rule.segments {
+			if _, err := path.Match(segment, ""); err != nil || segment == "" {
+				return nil, fmt.Errorf("Invalid path pattern '%s'", pattern)
+			}
+		}
+
+		// like in gitignore a glob without slash matches at any depth, plain names stay anchored to the root of the repo
+		if !strings.Contains(strings.TrimSuffix(pattern, "/"), "/") && strings.ContainsAny(rule.pattern, "*?[\\") {
+			rule.anyDepth = true
+			rule.segments = append([]string{"**"}, rule.segments...)
+		}
+
+		matcher.rules = append(matcher.rules, rule)
+	}
+
+	return matcher, nil
+}
+
+// Matches returns true if the given path, relative to the root of the repo, is selected by the patterns
+func (m *PathMatcher) Matches(filePath string) bool {
+	segments := strings.Split(strings.Trim(filePath, "/"), "/")
+
+	matches := m.includeByDefault
+	for _, rule := range m.rules {
+		// a rule matching a parent directory also matches the path
+		for i := 1; i <= len(segments); i++ {
+			if matchSegments(rule.segments, segments[:i]) {
+				matches = !rule.negated
+				break
+			}
+		}
+	}
+
+	return matches
+}
+
+// Literal returns true if the patterns are plain paths, without globs nor negations
+func (m *PathMatcher) Literal() bool {
+	if m.includeByDefault {
+		return false
+	}
+
+	for _, rule := range m.rules {
+		if rule.negated || strings.ContainsAny(rule.pattern, "*?[\\") {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Paths returns the patterns of the matcher, without their leading ! nor their surrounding slashes
+func (m *PathMatcher) Paths() []string {
+	paths := []string{}
+	for _, rule := range m.rules {
+		paths = append(paths, rule.pattern)
+	}
+
+	return paths
+}
+
+// SparseCheckoutPatterns returns the patterns of the matcher in the format of a non-cone git sparse-checkout file
+func (m *PathMatcher) SparseCheckoutPatterns() []string {
+	patterns := []string{}
+	if m.includeByDefault {
+		patterns = append(patterns, "/*")
+	}
+
+	for _, rule := range m.rules {
+		pattern := "/" + rule.pattern
+		if rule.anyDepth {
+			pattern = rule.pattern
+		}
+		if rule.negated {
+			pattern = "!" + pattern
+		}
+		patterns = append(patterns, pattern)
+	}
+
+	return patterns
+}
+
+func matchSegments(pattern []string, segments []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(segments); i++ {
+				if matchSegments(pattern[1:], segments[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(segments) == 0 {
+			return false
+		}
+
+		if matched, _ := path.Match(pattern[0], segments[0]); !matched {
+			return false
+		}
+
+		pattern = pattern[1:]
+		segments = segments[1:]
+	}
+
+	return len(segments) == 0
+}
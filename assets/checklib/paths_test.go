@@ -0,0 +1,118 @@
+package checklib
+
+import (
+	"testing"
+
+	"../common"
+)
+
+func getPathMatcherFixture(t *testing.T, patterns ...string) *PathMatcher {
+	matcher, err := NewPathMatcher(patterns)
+	if err != nil {
+		t.Fatal("Expected nil error, got ", err)
+	}
+
+	return matcher
+}
+
+func TestPathMatcher_NoPatterns(t *testing.T) {
+	matcher := getPathMatcherFixture(t)
+
+	if !matcher.Matches("any/file.go") {
+		t.Error("Expected any/file.go to match, got no match")
+	}
+}
+
+func TestPathMatcher_Directory(t *testing.T) {
+	matcher := getPathMatcherFixture(t, "api")
+
+	if !matcher.Matches("api/handlers/users.go") {
+		t.Error("Expected api/handlers/users.go to match, got no match")
+	}
+	if matcher.Matches("api-docs/index.md") {
+		t.Error("Expected api-docs/index.md not to match, got a match")
+	}
+}
+
+func TestPathMatcher_DoubleStar(t *testing.T) {
+	matcher := getPathMatcherFixture(t, "services/**/src/*.go")
+
+	for _, path := range []string{"services/users/src/main.go", "services/src/main.go", "services/a/b/src/main.go"} {
+		if !matcher.Matches(path) {
+			t.Error("Expected path to match, got no match for ", path)
+		}
+	}
+	for _, path := range []string{"services/users/src/main.js", "services/users/src/sub/main.go", "other/src/main.go"} {
+		if matcher.Matches(path) {
+			t.Error("Expected path not to match, got a match for ", path)
+		}
+	}
+}
+
+func TestPathMatcher_Negation(t *testing.T) {
+	matcher := getPathMatcherFixture(t, "!docs")
+
+	if !matcher.Matches("api/main.go") {
+		t.Error("Expected api/main.go to match, got no match")
+	}
+	if matcher.Matches("docs/index.md") {
+		t.Error("Expected docs/index.md not to match, got a match")
+	}
+}
+
+func TestPathMatcher_GlobAnyDepth(t *testing.T) {
+	matcher := getPathMatcherFixture(t, SourcePathPatterns(common.ConcourseSource{IgnorePaths: []string{"*.md"}})...)
+
+	for _, path := range []string{"README.md", "docs/README.md", "api/docs/index.md"} {
+		if matcher.Matches(path) {
+			t.Error("Expected path not to match, got a match for ", path)
+		}
+	}
+	if !matcher.Matches("api/main.go") {
+		t.Error("Expected api/main.go to match, got no match")
+	}
+}
+
+func TestPathMatcher_LastMatchWins(t *testing.T) {
+	matcher := getPathMatcherFixture(t, "api", "!api/**/*.md", "api/README.md")
+
+	if !matcher.Matches("api/README.md") {
+		t.Error("Expected api/README.md to match, got no match")
+	}
+	if matcher.Matches("api/docs/usage.md") {
+		t.Error("Expected api/docs/usage.md not to match, got a match")
+	}
+	if !matcher.Matches("api/main.go") {
+		t.Error("Expected api/main.go to match, got no match")
+	}
+}
+
+func TestPathMatcher_InvalidPattern(t *testing.T) {
+	_, err := NewPathMatcher([]string{"api/[docs"})
+
+	if err == nil {
+		t.Error("Expected non-nil error, got nil")
+	}
+}
+
+func TestPathMatcher_Literal(t *testing.T) {
+	if !getPathMatcherFixture(t, "api", "lib/").Literal() {
+		t.Error("Expected plain paths to be literal, got not literal")
+	}
+	if getPathMatcherFixture(t, "api", "!api/docs").Literal() {
+		t.Error("Expected negated paths not to be literal, got literal")
+	}
+	if getPathMatcherFixture(t, "api/*.go").Literal() {
+		t.Error("Expected globs not to be literal, got literal")
+	}
+}
+
+func TestSourcePathPatterns(t *testing.T) {
+	source := common.ConcourseSource{Paths: []string{"api"}, IgnorePaths: []string{"api/docs", "!api/docs/api.md"}}
+
+	patterns := SourcePathPatterns(source)
+
+	if len(patterns) != 3 || patterns[0] != "api" || patterns[1] != "!api/docs" || patterns[2] != "api/docs/api.md" {
+		t.Error("Expected patterns to be [api !api/docs api/docs/api.md], got ", patterns)
+	}
+}
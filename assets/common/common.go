@@ -2,10 +2,12 @@ package common
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"os/exec"
 	"regexp"
@@ -72,57 +74,135 @@ func SetupSSHKey(source ConcourseSource) error {
 	return nil
 }
 
-// RunGitCommand generically runs a Git command
-func RunGitCommand(command string, formating ...interface{}) error {
-	cmd := prepareGitCommand(command, formating...)
-	return cmd.Run()
-}
+// SetupSubmoduleCredentials sets up the SSH keys and HTTPS credentials used for submodules living on other hosts
+func SetupSubmoduleCredentials(source ConcourseSource) error {
+	if len(source.SubmoduleCredentials) == 0 {
+		return nil
+	}
+
+	homeDir := os.Getenv("HOME")
 
-// RunGitCommand generically runs a Git command and saves output to a file in .git directory
-func RunGitCommandSaveOutputToFile(command string, outputFilename string) error {
-	cmd := prepareGitCommand(command)
-	output, err := cmd.Output()
+	sshConfig, err := os.OpenFile(homeDir+"/.ssh/config", os.O_APPEND|os.O_CREATE|os.O_WRONLY, os.FileMode(0600))
 	if err != nil {
 		return err
 	}
+	defer sshConfig.Close()
 
-	err = os.MkdirAll(os.Args[1]+"/.git", os.FileMode(0600))
+	gitCredentials := []string{}
+	for _, credential := range source.SubmoduleCredentials {
+		if credential.Host == "" {
+			return errors.New("Submodule credentials must specify a host")
+		}
+
+		if credential.PrivateKey != "" {
+			keyFile, err := writeTempFile("git-private-key-", credential.PrivateKey)
+			if err != nil {
+				return err
+			}
+
+			_, err = sshConfig.WriteString(sshHostConfig(credential.Host, keyFile))
+			if err != nil {
+				return err
+			}
+		}
+
+		if credential.Username != "" {
+			gitCredentials = append(gitCredentials, gitCredentialURL(credential))
+		}
+	}
+
+	if len(gitCredentials) == 0 {
+		return nil
+	}
+
+	err = ioutil.WriteFile(homeDir+"/.git-credentials", []byte(strings.Join(gitCredentials, "\n")+"\n"), os.FileMode(0600))
 	if err != nil {
 		return err
 	}
 
-	// remove enclosing quotes if they exist
-	if len(output) > 0 && output[0] == '"' {
-		output = output[1:]
+	return NewGitRunner("").Run("config", "--global", "credential.helper", "store")
+}
+
+// SetupSigningKeys imports the GPG keys and SSH allowed signers of the source, so that git verifies signatures against them only
+func SetupSigningKeys(source ConcourseSource) error {
+	if source.SigningKeys != "" {
+		gnupgHome := "/tmp/git-gnupg"
+		err := os.MkdirAll(gnupgHome, os.FileMode(0700))
+		if err != nil {
+			return err
+		}
+		os.Setenv("GNUPGHOME", gnupgHome)
+
+		importCmd := exec.Command("gpg", "--batch", "--import")
+		importCmd.Stdin = strings.NewReader(source.SigningKeys)
+		importCmd.Stderr = os.Stderr
+		err = importCmd.Run()
+		if err != nil {
+			return err
+		}
+
+		// the imported keys are the whole keyring, so they are trusted for git to report their signatures as good
+		keys, err := exec.Command("gpg", "--batch", "--with-colons", "--fingerprint").Output()
+		if err != nil {
+			return err
+		}
+
+		trustCmd := exec.Command("gpg", "--batch", "--import-ownertrust")
+		trustCmd.Stdin = strings.NewReader(ownerTrust(string(keys)))
+		trustCmd.Stderr = os.Stderr
+		err = trustCmd.Run()
+		if err != nil {
+			return err
+		}
 	}
-	if len(output) > 0 && output[len(output)-1] == '"' {
-		output = output[:len(output)-1]
+
+	if source.AllowedSigners != "" {
+		err := ioutil.WriteFile("/tmp/git-allowed-signers", []byte(source.AllowedSigners), os.FileMode(0600))
+		if err != nil {
+			return err
+		}
+
+		return NewGitRunner("").Run("config", "--global", "gpg.ssh.allowedSignersFile", "/tmp/git-allowed-signers")
 	}
-	err = ioutil.WriteFile(os.Args[1]+"/.git/"+outputFilename, output, os.FileMode(0600))
+
+	return nil
+}
+
+// WriteResourceFile writes the given contents to a file within the resource directory of the destination
+func WriteResourceFile(filename string, contents []byte) error {
+	resourceDir := os.Args[1] + "/" + ResourceDir
+
+	err := os.MkdirAll(resourceDir, os.FileMode(0700))
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return ioutil.WriteFile(resourceDir+"/"+filename, contents, os.FileMode(0600))
 }
 
-// Prepares git command along with arguments that will be executed
-func prepareGitCommand(command string, formating ...interface{}) *exec.Cmd {
-	if formating != nil {
-		command = fmt.Sprintf(command, formating...)
+// WriteResourceJSON writes the given value as indented JSON to a file within the resource directory of the destination
+func WriteResourceJSON(filename string, value interface{}) error {
+	contents := bytes.Buffer{}
+	encoder := json.NewEncoder(&contents)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+
+	err := encoder.Encode(value)
+	if err != nil {
+		return err
 	}
-	args := strings.Split(command, " ")
-	cmd := exec.Command("git", args...)
-	cmd.Stderr = os.Stderr
-	return cmd
+
+	return WriteResourceFile(filename, contents.Bytes())
 }
 
-// OutputVersion prints a version string to standard out based on the given ConcourseVersion object
-func OutputVersion(version ConcourseVersion) error {
+// OutputVersion prints a version string to standard out based on the given ConcourseVersion object and metadata
+func OutputVersion(version ConcourseVersion, metadata []ConcourseMetadataField) error {
 	output, err := json.Marshal(struct {
-		Version *ConcourseVersion `json:"version"`
+		Version  *ConcourseVersion        `json:"version"`
+		Metadata []ConcourseMetadataField `json:"metadata"`
 	}{
-		Version: &version,
+		Version:  &version,
+		Metadata: metadata,
 	})
 
 	if err != nil {
@@ -133,6 +213,54 @@ func OutputVersion(version ConcourseVersion) error {
 	return nil
 }
 
+// writeTempFile writes the content to a new file only readable by the user, whose name starts with the prefix, and returns its path
+func writeTempFile(prefix string, content string) (string, error) {
+	file, err := ioutil.TempFile("", prefix)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	_, err = file.WriteString(content)
+	if err != nil {
+		return "", err
+	}
+
+	return file.Name(), nil
+}
+
+func sshHostConfig(host string, keyFile string) string {
+	return fmt.Sprintf("\nHost %s\n  IdentityFile %s\n  IdentitiesOnly yes\n", host, keyFile)
+}
+
+func gitCredentialURL(credential ConcourseSubmoduleCredential) string {
+	credentialURL := url.URL{
+		Scheme: "https",
+		User:   url.UserPassword(credential.Username, credential.Password),
+		Host:   credential.Host,
+	}
+	return credentialURL.String()
+}
+
+func ownerTrust(gpgColonsOutput string) string {
+	trust := ""
+	primaryKey := false
+	for _, line := range strings.Split(gpgColonsOutput, "\n") {
+		fields := strings.Split(line, ":")
+		switch {
+		case fields[0] == "pub":
+			primaryKey = true
+		case fields[0] == "fpr" && primaryKey && len(fields) > 9:
+			trust += fields[9] + ":6:\n"
+			primaryKey = false
+		case fields[0] != "fpr":
+			primaryKey = false
+		}
+	}
+
+	return trust
+}
+
 func retrieveEnvVarsFromAgent(agentOutput string) map[string]string {
 	m := map[string]string{}
 
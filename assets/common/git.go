@@ -0,0 +1,159 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// DefaultGitRetries and DefaultGitRetryDelay are the retry settings of a GitRunner returned by NewGitRunner
+const (
+	DefaultGitRetries    = 3
+	DefaultGitRetryDelay = 5 * time.Second
+)
+
+// transientGitErrors are the parts of git error messages indicating a network failure worth retrying
+var transientGitErrors = []string{
+	"could not resolve host",
+	"temporary failure in name resolution",
+	"connection timed out",
+	"operation timed out",
+	"connection reset by peer",
+	"connection refused",
+	"the remote end hung up unexpectedly",
+	"early eof",
+	"rpc failed",
+	"kex_exchange_identification",
+	"ssh: connect to host",
+}
+
+// GitRunner runs git commands from explicit arguments, without going through a shell or splitting strings
+type GitRunner struct {
+	// Dir is the working directory of the commands, the current directory when empty
+	Dir string
+	// Env holds extra KEY=value environment variables added to the environment of the process
+	Env []string
+	// Timeout bounds every attempt of a command when positive
+	Timeout time.Duration
+	// Retries is the number of times a command failing with a transient network error is retried
+	Retries    int
+	RetryDelay time.Duration
+}
+
+// GitError the error returned when a git command fails, holding the stderr output of the command
+type GitError struct {
+	Args   []string
+	Err    error
+	Stderr string
+}
+
+func (e *GitError) Error() string {
+	args := []string{}
+	stderr := strings.TrimSpace(e.Stderr)
+	// clone and fetch URLs may hold credentials
+	for _, arg := range e.Args {
+		if strings.Contains(arg, "://") {
+			stderr = strings.ReplaceAll(stderr, arg, RedactURL(arg))
+			arg = RedactURL(arg)
+		}
+		args = append(args, arg)
+	}
+
+	message := fmt.Sprintf("git %s: %s", strings.Join(args, " "), e.Err.Error())
+	if stderr != "" {
+		message += ": " + stderr
+	}
+
+	return message
+}
+
+// NewGitRunner returns a GitRunner running commands in the given directory and retrying transient network failures
+func NewGitRunner(dir string) *GitRunner {
+	return &GitRunner{
+		Dir:        dir,
+		Retries:    DefaultGitRetries,
+		RetryDelay: DefaultGitRetryDelay,
+	}
+}
+
+// Run runs the git command with the given arguments
+func (r *GitRunner) Run(args ...string) error {
+	_, err := r.RunContext(context.Background(), args...)
+	return err
+}
+
+// Output runs the git command with the given arguments and returns its trimmed output
+func (r *GitRunner) Output(args ...string) (string, error) {
+	output, err := r.RunContext(context.Background(), args...)
+	return strings.TrimSpace(string(output)), err
+}
+
+// RawOutput runs the git command with the given arguments and returns its untouched output
+func (r *GitRunner) RawOutput(args ...string) ([]byte, error) {
+	return r.RunContext(context.Background(), args...)
+}
+
+// RunContext runs the git command with the given arguments until the context is done and returns its untouched output
+func (r *GitRunner) RunContext(ctx context.Context, args ...string) ([]byte, error) {
+	for attempt := 0; ; attempt++ {
+		output, err := r.runOnce(ctx, args)
+		if err == nil || attempt >= r.Retries || !isTransientGitError(err) || ctx.Err() != nil {
+			return output, err
+		}
+
+		fmt.Fprintf(os.Stderr, "Retrying git %s after a network failure\n", args[0])
+		select {
+		case <-ctx.Done():
+			return output, err
+		case <-time.After(r.RetryDelay * time.Duration(attempt+1)):
+		}
+	}
+}
+
+func (r *GitRunner) runOnce(ctx context.Context, args []string) ([]byte, error) {
+	if r.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.Timeout)
+		defer cancel()
+	}
+
+	stdout := bytes.Buffer{}
+	stderr := bytes.Buffer{}
+
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = r.Dir
+	cmd.Env = append(os.Environ(), r.Env...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = io.MultiWriter(&stderr, os.Stderr)
+
+	err := cmd.Run()
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("timed out after %s", r.Timeout)
+		}
+		return stdout.Bytes(), &GitError{Args: args, Err: err, Stderr: stderr.String()}
+	}
+
+	return stdout.Bytes(), nil
+}
+
+func isTransientGitError(err error) bool {
+	gitErr, ok := err.(*GitError)
+	if !ok {
+		return false
+	}
+
+	stderr := strings.ToLower(gitErr.Stderr)
+	for _, transientError := range transientGitErrors {
+		if strings.Contains(stderr, transientError) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -5,31 +5,137 @@ import (
 	"strings"
 )
 
-// BranchesSeperator indicates the separation within a single string of the branch name and commit sha in a Stash reponse
+// BranchesSeperator indicates the separation within a single string of the branch name, commit sha and optional state in a Stash reponse
 const (
 	BranchesSeperator = "::"
 )
 
+// VerifySignaturesRef and VerifySignaturesCommits are the values of the verify_signatures param
+const (
+	VerifySignaturesRef     = "ref"
+	VerifySignaturesCommits = "commits"
+)
+
+// ResourceDir the directory of the destination, relative to its root, in which in writes its files
+const (
+	ResourceDir = ".git/resource"
+)
+
+// ModeBranches and ModePullRequests are the values of the mode source field
+const (
+	ModeBranches     = "branches"
+	ModePullRequests = "pull_requests"
+)
+
+// SubmodulesAll and SubmodulesNone are the special values of the submodules param
+const (
+	SubmodulesAll  = "all"
+	SubmodulesNone = "none"
+)
+
 // ConcourseSource the structure defining the expected source input parameter format, supports both check and in
 type ConcourseSource struct {
-	StashUrl       string   `json:"stash_url"`
-	ProjectName    string   `json:"project_name"`
-	RepoName       string   `json:"repo_name"`
-	PROnly         bool     `json:"pronly"`
-	DaysBack       int      `json:"days_back"`
-	Branches       string   `json:"branches"`
-	IgnoreBranches string   `json:"ignore_branches"`
-	Username       string   `json:"username"`
-	Password       string   `json:"password"`
-	RepoUrl        string   `json:"repo"`
-	PrivateKey     string   `json:"private_key"`
-	Paths          []string `json:"paths"`
+	Mode                 string     `json:"mode"`
+	StashUrl             string     `json:"stash_url"`
+	ProjectName          string     `json:"project_name"`
+	RepoName             string     `json:"repo_name"`
+	Repos                StringList `json:"repos"`
+	RepoPattern          string     `json:"repo_pattern"`
+	PROnly               bool       `json:"pronly"`
+	DaysBack             int        `json:"days_back"`
+	Branches             string     `json:"branches"`
+	IgnoreBranches       string     `json:"ignore_branches"`
+	TargetBranches       string     `json:"target_branches"`
+	IgnoreTargetBranches string     `json:"ignore_target_branches"`
+	Authors              StringList `json:"authors"`
+	IgnoreAuthors        StringList `json:"ignore_authors"`
+	MatchCommitAuthor    bool       `json:"match_commit_author"`
+	SkipWIP              bool       `json:"skip_wip"`
+	WIPPattern           string     `json:"wip_pattern"`
+	MinApprovals         int        `json:"min_approvals"`
+	RequiredReviewers    StringList `json:"required_reviewers"`
+	TriggerComment       string     `json:"trigger_comment"`
+	TriggerCommentUsers  StringList `json:"trigger_comment_users"`
+	Forks                bool       `json:"forks"`
+	ForkTrustedReviewers StringList `json:"fork_trusted_reviewers"`
+	SkipBuiltStatusKey   string     `json:"skip_built_status_key"`
+	CompactVersions      bool       `json:"compact_versions"`
+	EveryCommit          bool       `json:"every_commit"`
+	MaxCommits           int        `json:"max_commits"`
+	Username             string     `json:"username"`
+	Password             string     `json:"password"`
+	RepoUrl              string     `json:"repo"`
+	PrivateKey           string     `json:"private_key"`
+	Paths                []string   `json:"paths"`
+	IgnorePaths          []string   `json:"ignore_paths"`
+	PageSize             int        `json:"page_size"`
+	MaxBranches          int        `json:"max_branches"`
+	MaxChanges           int        `json:"max_changes"`
+
+	SubmoduleCredentials []ConcourseSubmoduleCredential `json:"submodule_credentials"`
+	SigningKeys          string                         `json:"signing_keys"`
+	AllowedSigners       string                         `json:"allowed_signers"`
+	ReferenceCacheDir    string                         `json:"reference_cache_dir"`
+	MirrorUrls           StringList                     `json:"mirror_url"`
+}
+
+// ConcourseSubmoduleCredential the structure defining the credentials used for submodules living on a given host
+type ConcourseSubmoduleCredential struct {
+	Host       string `json:"host"`
+	PrivateKey string `json:"private_key"`
+	Username   string `json:"username"`
+	Password   string `json:"password"`
+}
+
+// ConcourseParams the structure defining the expected params input parameter format, supports in
+type ConcourseParams struct {
+	Submodules         StringList `json:"submodules"`
+	SubmoduleRecursive *bool      `json:"submodule_recursive"`
+	SubmoduleRemote    bool       `json:"submodule_remote"`
+	SubmoduleDepth     *int       `json:"submodule_depth"`
+	SparsePaths        []string   `json:"sparse_paths"`
+	PRDiff             bool       `json:"pr_diff"`
+	PRDiffPathsOnly    bool       `json:"pr_diff_paths_only"`
+	VerifySignatures   string     `json:"verify_signatures"`
+	SkipDownload       bool       `json:"skip_download"`
+	PRCommits          bool       `json:"pr_commits"`
+	PRActivities       bool       `json:"pr_activities"`
+	PRActivitiesLimit  int        `json:"pr_activities_limit"`
+
+	BuildHeadIfRewritten bool `json:"build_head_if_rewritten"`
+}
+
+// ConcourseMetadataField the structure defining a single field of the metadata output
+type ConcourseMetadataField struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
 }
 
 // ConcourseInput the structure defining the expected input parameter format of the script
 type ConcourseInput struct {
 	Source  ConcourseSource  `json:"source"`
 	Version ConcourseVersion `json:"version"`
+	Params  ConcourseParams  `json:"params"`
+}
+
+// StringList a list of strings which may be given in JSON as either a single string or an array of strings
+type StringList []string
+
+// UnmarshalJSON populates the given StringList with the given byte stream
+func (l *StringList) UnmarshalJSON(b []byte) error {
+	var single string
+	if json.Unmarshal(b, &single) == nil {
+		*l = StringList{single}
+		return nil
+	}
+
+	list := []string{}
+	err := json.Unmarshal(b, &list)
+	if err != nil {
+		return err
+	}
+	*l = StringList(list)
+	return nil
 }
 
 // ConcourseVersion the structure defining the expected version input parameter format
@@ -37,6 +143,15 @@ type ConcourseVersion struct {
 	Branches      []string `json:"the_branches"`
 	ChangedBranch string   `json:"changed_branch"`
 	Ref           string   `json:"ref"`
+	PullRequestID string   `json:"pr_id"`
+	TargetBranch  string   `json:"target_branch"`
+	TargetRef     string   `json:"target_ref"`
+	CommentID     string   `json:"comment_id"`
+	SourceProject string   `json:"source_project"`
+	SourceRepo    string   `json:"source_repo"`
+	Repo          string   `json:"repo"`
+	Snapshot      string   `json:"snapshot"`
+	Watermark     string   `json:"watermark"`
 }
 
 // MarshalJSON converts the ConcourseVersion struct into a marshalled JSON object
@@ -44,7 +159,33 @@ func (v *ConcourseVersion) MarshalJSON() ([]byte, error) {
 	m := map[string]string{}
 	m["changed_branch"] = v.ChangedBranch
 	m["ref"] = v.Ref
-	m["the_branches"] = strings.Join(v.Branches, ",")
+
+	// compact versions hold the hash of the branches instead of the branches themselves
+	if v.Snapshot != "" {
+		m["snapshot"] = v.Snapshot
+	} else {
+		m["the_branches"] = strings.Join(v.Branches, ",")
+	}
+	if v.Watermark != "" {
+		m["watermark"] = v.Watermark
+	}
+
+	// pull request fields are only set when the pull request is known, leaving plain versions of branches mode unchanged
+	if v.PullRequestID != "" {
+		m["pr_id"] = v.PullRequestID
+		m["target_branch"] = v.TargetBranch
+		m["target_ref"] = v.TargetRef
+	}
+	if v.CommentID != "" {
+		m["comment_id"] = v.CommentID
+	}
+	if v.SourceRepo != "" {
+		m["source_project"] = v.SourceProject
+		m["source_repo"] = v.SourceRepo
+	}
+	if v.Repo != "" {
+		m["repo"] = v.Repo
+	}
 	return json.Marshal(m)
 }
 
@@ -58,6 +199,15 @@ func (v *ConcourseVersion) UnmarshalJSON(b []byte) error {
 	}
 	v.ChangedBranch = m["changed_branch"]
 	v.Ref = m["ref"]
+	v.PullRequestID = m["pr_id"]
+	v.TargetBranch = m["target_branch"]
+	v.TargetRef = m["target_ref"]
+	v.CommentID = m["comment_id"]
+	v.SourceProject = m["source_project"]
+	v.SourceRepo = m["source_repo"]
+	v.Repo = m["repo"]
+	v.Snapshot = m["snapshot"]
+	v.Watermark = m["watermark"]
 	if len(m["the_branches"]) > 0 {
 		v.Branches = strings.Split(m["the_branches"], ",")
 	}
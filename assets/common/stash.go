@@ -0,0 +1,510 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// StashUser the structure of a user in a Stash response
+type StashUser struct {
+	Name         string `json:"name"`
+	EmailAddress string `json:"emailAddress"`
+	DisplayName  string `json:"displayName"`
+	Slug         string `json:"slug"`
+}
+
+// StashParticipant the structure of a pull request author, reviewer or participant in a Stash response
+type StashParticipant struct {
+	User               StashUser `json:"user"`
+	Role               string    `json:"role"`
+	Approved           bool      `json:"approved"`
+	Status             string    `json:"status"`
+	LastReviewedCommit string    `json:"lastReviewedCommit"`
+}
+
+// StashProject the structure of a project in a Stash response
+type StashProject struct {
+	Key string `json:"key"`
+}
+
+// StashRepository the structure of a repository in a Stash response
+type StashRepository struct {
+	Slug    string       `json:"slug"`
+	Project StashProject `json:"project"`
+	Links   StashLinks   `json:"links"`
+}
+
+// StashRef the structure of the source or target ref of a pull request in a Stash response
+type StashRef struct {
+	ID           string          `json:"id"`
+	DisplayID    string          `json:"displayId"`
+	LatestCommit string          `json:"latestCommit"`
+	Repository   StashRepository `json:"repository"`
+}
+
+// StashLink the structure of a single link in a Stash response
+type StashLink struct {
+	Href string `json:"href"`
+	Name string `json:"name"`
+}
+
+// StashLinks the structure of the links of an entity in a Stash response
+type StashLinks struct {
+	Self  []StashLink `json:"self"`
+	Clone []StashLink `json:"clone"`
+}
+
+// StashPullRequest the structure of a pull request in a Stash response
+type StashPullRequest struct {
+	ID           int                `json:"id"`
+	Title        string             `json:"title"`
+	Description  string             `json:"description"`
+	State        string             `json:"state"`
+	Draft        bool               `json:"draft"`
+	CreatedDate  int64              `json:"createdDate"`
+	UpdatedDate  int64              `json:"updatedDate"`
+	FromRef      StashRef           `json:"fromRef"`
+	ToRef        StashRef           `json:"toRef"`
+	Author       StashParticipant   `json:"author"`
+	Reviewers    []StashParticipant `json:"reviewers"`
+	Participants []StashParticipant `json:"participants"`
+	Links        StashLinks         `json:"links"`
+}
+
+// StashCommit the structure of a commit in a Stash response
+type StashCommit struct {
+	ID                 string    `json:"id"`
+	DisplayID          string    `json:"displayId"`
+	Author             StashUser `json:"author"`
+	AuthorTimestamp    int64     `json:"authorTimestamp"`
+	Committer          StashUser `json:"committer"`
+	CommitterTimestamp int64     `json:"committerTimestamp"`
+	Message            string    `json:"message"`
+}
+
+// StashComment the structure of a pull request comment in a Stash response
+type StashComment struct {
+	ID          int       `json:"id"`
+	Text        string    `json:"text"`
+	Author      StashUser `json:"author"`
+	CreatedDate int64     `json:"createdDate"`
+}
+
+// StashActivity the structure of a pull request activity in a Stash response
+type StashActivity struct {
+	ID            int           `json:"id"`
+	CreatedDate   int64         `json:"createdDate"`
+	User          StashUser     `json:"user"`
+	Action        string        `json:"action"`
+	CommentAction string        `json:"commentAction"`
+	Comment       *StashComment `json:"comment"`
+	PreviousTitle string        `json:"previousTitle"`
+}
+
+// StashBuildStatus the structure of a build status of a commit in a Stash response
+type StashBuildStatus struct {
+	State     string `json:"state"`
+	Key       string `json:"key"`
+	Name      string `json:"name"`
+	URL       string `json:"url"`
+	DateAdded int64  `json:"dateAdded"`
+}
+
+// StashBuildStats the structure of the build status counts of a commit in a Stash response
+type StashBuildStats struct {
+	Successful int `json:"successful"`
+	InProgress int `json:"inProgress"`
+	Failed     int `json:"failed"`
+}
+
+// StashPage the structure of a single page of a paged Stash response
+type StashPage struct {
+	Values        []json.RawMessage `json:"values"`
+	IsLastPage    bool              `json:"isLastPage"`
+	NextPageStart int               `json:"nextPageStart"`
+}
+
+// HasStashConfig returns true if the source holds enough configuration to query the Stash REST API
+func HasStashConfig(source ConcourseSource) bool {
+	return source.StashUrl != "" && source.ProjectName != "" && source.RepoName != ""
+}
+
+// StashAPIURL returns the REST API URL of the Stash service of the source, followed by the given formatted path
+func StashAPIURL(source ConcourseSource, path string, formating ...interface{}) string {
+	return fmt.Sprintf("https://%s:%s@%s/rest/api/1.0",
+		source.Username,
+		source.Password,
+		source.StashUrl) + fmt.Sprintf(path, formating...)
+}
+
+// StashRepoURL returns the REST API URL of the repo of the source, followed by the given formatted path
+func StashRepoURL(source ConcourseSource, path string, formating ...interface{}) string {
+	return StashAPIURL(source, "/projects/%s/repos/%s", source.ProjectName, source.RepoName) + fmt.Sprintf(path, formating...)
+}
+
+// StashBuildStatusURL returns the build status REST API URL followed by the given formatted path
+func StashBuildStatusURL(source ConcourseSource, path string, formating ...interface{}) string {
+	return fmt.Sprintf("https://%s:%s@%s/rest/build-status/1.0",
+		source.Username,
+		source.Password,
+		source.StashUrl) + fmt.Sprintf(path, formating...)
+}
+
+// GetStashResponse returns the body of a successful call to the Stash service, an error otherwise
+func GetStashResponse(stashURL string) ([]byte, error) {
+	resp, err := http.DefaultClient.Get(stashURL)
+	if err != nil {
+		return nil, err
+	}
+
+	return readStashResponse(resp, stashURL)
+}
+
+// PostStashJSON returns the body of a successful call to the Stash service posting the given value as JSON, an error otherwise
+func PostStashJSON(stashURL string, value interface{}) ([]byte, error) {
+	body, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Post(stashURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	return readStashResponse(resp, stashURL)
+}
+
+func readStashResponse(resp *http.Response, stashURL string) ([]byte, error) {
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("Expected 200 response code but got %v from %s: %s", resp.StatusCode, RedactURL(stashURL), string(respBody))
+	}
+
+	return respBody, nil
+}
+
+// GetStashPagedValues returns the values of every page of a paged Stash response up to max, and true if more were available
+func GetStashPagedValues(stashURL string, pageSize int, max int) ([]json.RawMessage, bool, error) {
+	values := []json.RawMessage{}
+	start := 0
+
+	for {
+		limit := pageSize
+		if max > 0 && max-len(values) < limit {
+			limit = max - len(values)
+		}
+
+		respBody, err := GetStashResponse(pagedURL(stashURL, start, limit))
+		if err != nil {
+			return values, false, err
+		}
+
+		page := StashPage{}
+		err = json.Unmarshal(respBody, &page)
+		if err != nil {
+			return values, false, err
+		}
+
+		values = append(values, page.Values...)
+
+		if page.IsLastPage || len(page.Values) == 0 {
+			return values, false, nil
+		}
+
+		if max > 0 && len(values) >= max {
+			return values[:max], true, nil
+		}
+
+		start = page.NextPageStart
+	}
+}
+
+// GetStashProjectRepos returns the repositories of the project of the source
+func GetStashProjectRepos(source ConcourseSource, pageSize int) ([]StashRepository, error) {
+	values, _, err := GetStashPagedValues(StashAPIURL(source, "/projects/%s/repos", url.PathEscape(source.ProjectName)), pageSize, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	repositories := []StashRepository{}
+	for _, value := range values {
+		repository := StashRepository{}
+		err = json.Unmarshal(value, &repository)
+		if err != nil {
+			return nil, err
+		}
+		repositories = append(repositories, repository)
+	}
+
+	return repositories, nil
+}
+
+// GetStashRepository returns the repository of the source
+func GetStashRepository(source ConcourseSource) (StashRepository, error) {
+	repository := StashRepository{}
+
+	respBody, err := GetStashResponse(StashRepoURL(source, ""))
+	if err != nil {
+		return repository, err
+	}
+
+	err = json.Unmarshal(respBody, &repository)
+	return repository, err
+}
+
+// GetStashPullRequestsForBranch returns the open pull requests whose source is the given branch of the repo of the source
+func GetStashPullRequestsForBranch(source ConcourseSource, branch string) ([]StashPullRequest, error) {
+	stashURL := StashRepoURL(source, "/pull-requests?state=OPEN&direction=OUTGOING&at=%s", url.QueryEscape("refs/heads/"+branch))
+
+	values, _, err := GetStashPagedValues(stashURL, 100, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	pullRequests := []StashPullRequest{}
+	for _, value := range values {
+		pullRequest := StashPullRequest{}
+		err = json.Unmarshal(value, &pullRequest)
+		if err != nil {
+			return nil, err
+		}
+		pullRequests = append(pullRequests, pullRequest)
+	}
+
+	return pullRequests, nil
+}
+
+// GetStashPullRequest returns the pull request of the repo of the source with the given id
+func GetStashPullRequest(source ConcourseSource, id string) (StashPullRequest, error) {
+	pullRequest := StashPullRequest{}
+
+	respBody, err := GetStashResponse(StashRepoURL(source, "/pull-requests/%s", url.PathEscape(id)))
+	if err != nil {
+		return pullRequest, err
+	}
+
+	err = json.Unmarshal(respBody, &pullRequest)
+	return pullRequest, err
+}
+
+// GetStashCommit returns the commit of the repo of the source with the given id
+func GetStashCommit(source ConcourseSource, id string) (StashCommit, error) {
+	commit := StashCommit{}
+
+	respBody, err := GetStashResponse(StashRepoURL(source, "/commits/%s", url.PathEscape(id)))
+	if err != nil {
+		return commit, err
+	}
+
+	err = json.Unmarshal(respBody, &commit)
+	return commit, err
+}
+
+// GetStashPullRequestLatestCommit returns the latest commit of the pull request with the given id, also when it comes from a fork
+func GetStashPullRequestLatestCommit(source ConcourseSource, id int) (StashCommit, error) {
+	commit := StashCommit{}
+
+	values, _, err := GetStashPagedValues(StashRepoURL(source, "/pull-requests/%d/commits", id), 1, 1)
+	if err != nil {
+		return commit, err
+	}
+	if len(values) == 0 {
+		return commit, fmt.Errorf("Pull request %d has no commits", id)
+	}
+
+	err = json.Unmarshal(values[0], &commit)
+	return commit, err
+}
+
+// IsFork returns true if the source of the pull request is another repository than its target
+func (p StashPullRequest) IsFork() bool {
+	return !strings.EqualFold(p.FromRef.Repository.Project.Key, p.ToRef.Repository.Project.Key) ||
+		p.FromRef.Repository.Slug != p.ToRef.Repository.Slug
+}
+
+// GetStashPullRequestCommits returns the commits of the pull request with the given id, newest first, also when it comes from a fork
+func GetStashPullRequestCommits(source ConcourseSource, id int) ([]StashCommit, error) {
+	values, _, err := GetStashPagedValues(StashRepoURL(source, "/pull-requests/%d/commits", id), 100, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	commits := []StashCommit{}
+	for _, value := range values {
+		commit := StashCommit{}
+		err = json.Unmarshal(value, &commit)
+		if err != nil {
+			return nil, err
+		}
+		commits = append(commits, commit)
+	}
+
+	return commits, nil
+}
+
+// GetStashLatestCommits returns up to max commits reachable from until but not since, newest first, and true if there were more
+func GetStashLatestCommits(source ConcourseSource, until string, since string, max int) ([]StashCommit, bool, error) {
+	stashURL := StashRepoURL(source, "/commits?until=%s&since=%s", url.QueryEscape(until), url.QueryEscape(since))
+
+	values, more, err := GetStashPagedValues(stashURL, 100, max)
+	if err != nil {
+		return nil, false, err
+	}
+
+	commits := []StashCommit{}
+	for _, value := range values {
+		commit := StashCommit{}
+		err = json.Unmarshal(value, &commit)
+		if err != nil {
+			return nil, false, err
+		}
+		commits = append(commits, commit)
+	}
+
+	return commits, more, nil
+}
+
+// GetStashPullRequestActivities returns up to max of the latest activities of the pull request of the repo of the source, newest first
+func GetStashPullRequestActivities(source ConcourseSource, id int, max int) ([]StashActivity, error) {
+	values, _, err := GetStashPagedValues(StashRepoURL(source, "/pull-requests/%d/activities", id), 100, max)
+	if err != nil {
+		return nil, err
+	}
+
+	activities := []StashActivity{}
+	for _, value := range values {
+		activity := StashActivity{}
+		err = json.Unmarshal(value, &activity)
+		if err != nil {
+			return nil, err
+		}
+		activities = append(activities, activity)
+	}
+
+	return activities, nil
+}
+
+// GetStashPullRequestActivitiesSince returns the activities of the pull request created after the given timestamp, newest first
+func GetStashPullRequestActivitiesSince(source ConcourseSource, id int, since int64) ([]StashActivity, error) {
+	stashURL := StashRepoURL(source, "/pull-requests/%d/activities", id)
+	activities := []StashActivity{}
+	start := 0
+
+	for {
+		respBody, err := GetStashResponse(pagedURL(stashURL, start, 100))
+		if err != nil {
+			return nil, err
+		}
+
+		page := StashPage{}
+		err = json.Unmarshal(respBody, &page)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, value := range page.Values {
+			activity := StashActivity{}
+			err = json.Unmarshal(value, &activity)
+			if err != nil {
+				return nil, err
+			}
+
+			if activity.CreatedDate <= since {
+				return activities, nil
+			}
+			activities = append(activities, activity)
+		}
+
+		if page.IsLastPage || len(page.Values) == 0 {
+			return activities, nil
+		}
+
+		start = page.NextPageStart
+	}
+}
+
+// GetStashBuildStats returns the build status counts of the given commits, keyed by commit id
+func GetStashBuildStats(source ConcourseSource, ids []string) (map[string]StashBuildStats, error) {
+	stats := map[string]StashBuildStats{}
+
+	respBody, err := PostStashJSON(StashBuildStatusURL(source, "/commits/stats"), ids)
+	if err != nil {
+		return stats, err
+	}
+
+	err = json.Unmarshal(respBody, &stats)
+	return stats, err
+}
+
+// GetStashBuildStatuses returns the build statuses of the given commit, newest first
+func GetStashBuildStatuses(source ConcourseSource, id string) ([]StashBuildStatus, error) {
+	values, _, err := GetStashPagedValues(StashBuildStatusURL(source, "/commits/%s", url.PathEscape(id)), 100, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	buildStatuses := []StashBuildStatus{}
+	for _, value := range values {
+		buildStatus := StashBuildStatus{}
+		err = json.Unmarshal(value, &buildStatus)
+		if err != nil {
+			return nil, err
+		}
+		buildStatuses = append(buildStatuses, buildStatus)
+	}
+
+	return buildStatuses, nil
+}
+
+// GetStashGroupMembers returns the members of the group with the given name, which requires the permission to list group members
+func GetStashGroupMembers(source ConcourseSource, group string) ([]StashUser, error) {
+	stashURL := StashAPIURL(source, "/admin/groups/more-members?context=%s", url.QueryEscape(group))
+
+	values, _, err := GetStashPagedValues(stashURL, 100, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	users := []StashUser{}
+	for _, value := range values {
+		user := StashUser{}
+		err = json.Unmarshal(value, &user)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+
+	return users, nil
+}
+
+func pagedURL(stashURL string, start int, limit int) string {
+	separator := "?"
+	if strings.Contains(stashURL, "?") {
+		separator = "&"
+	}
+
+	return fmt.Sprintf("%s%sstart=%d&limit=%d", stashURL, separator, start, limit)
+}
+
+// RedactURL returns the URL with the password of its user info replaced, so that it can be logged
+func RedactURL(rawURL string) string {
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+
+	return parsedURL.Redacted()
+}
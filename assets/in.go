@@ -1,55 +1,151 @@
 package main
 
 import (
+	"fmt"
 	"os"
 	"strings"
 
+	"./checklib"
 	"./common"
+	"./inlib"
 )
 
 func main() {
 	input, err := common.GetInput()
 	common.HandleFatalError(err, "Error getting concourse input")
 
+	input, err = inlib.ResolveRepo(input)
+	common.HandleFatalError(err, "Error resolving repo of version")
+
+	common.HandleFatalError(inlib.ValidateParams(input), "Error while validating params")
+
+	pullRequest, err := inlib.FindPullRequest(input)
+	if inlib.PullRequestRequired(input.Params) {
+		common.HandleFatalError(err, "Error finding pull request")
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, "Warning: continuing without the pull request metadata:", err.Error())
+	}
+
+	metadata := inlib.PullRequestMetadata(pullRequest)
+	if input.Version.CommentID != "" {
+		metadata = append(metadata, common.ConcourseMetadataField{Name: "comment_id", Value: input.Version.CommentID})
+	}
+
+	if input.Params.SkipDownload {
+		common.HandleFatalError(inlib.WriteVersionFiles(input, pullRequest), "Error writing version files")
+
+		if input.Params.PRCommits {
+			common.HandleFatalError(inlib.WritePullRequestCommits(nil, input, pullRequest, input.Version.Ref, ""), "Error writing pull request commits")
+		}
+
+		if input.Params.PRActivities {
+			common.HandleFatalError(inlib.WritePullRequestActivities(input, pullRequest, input.Version.Ref), "Error writing pull request activities")
+		}
+
+		common.HandleFatalError(common.OutputVersion(input.Version, metadata), "Error marshaling version json")
+		return
+	}
+
 	common.HandleFatalError(common.SetupSSHKey(input.Source), "Error setting up ssh key")
 
-	common.HandleFatalError(
-		common.RunGitCommand("clone --single-branch %s --branch %s %s", input.Source.RepoUrl, input.Version.ChangedBranch, os.Args[1]),
-		"Error cloning git repo",
-	)
+	common.HandleFatalError(common.SetupSubmoduleCredentials(input.Source), "Error setting up submodule credentials")
 
-	common.HandleFatalError(os.Chdir(os.Args[1]), "Error changing to repo directory")
+	common.HandleFatalError(common.SetupSigningKeys(input.Source), "Error setting up signing keys")
 
-	common.HandleFatalError(
-		common.RunGitCommand("checkout -q %s", input.Version.Ref),
-		"Error checking out ref",
-	)
+	sparsePaths := inlib.SparsePaths(input)
 
-	common.HandleFatalError(
-		common.RunGitCommand("submodule update --init --depth 1 --recursive"),
-		"Error updating submodules",
-	)
+	referenceRepo := ""
+	releaseReferenceRepo := func() {}
+	if input.Source.ReferenceCacheDir != "" {
+		referenceRepo, releaseReferenceRepo, err = inlib.UpdateReferenceRepository(input.Source)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Warning: cloning without the reference repository:", err.Error())
+			referenceRepo = ""
+			releaseReferenceRepo = func() {}
+		}
+	}
+
+	cloneURL, err := inlib.Clone(input, sparsePaths, referenceRepo, os.Args[1])
+	common.HandleFatalError(err, "Error cloning git repo")
+	releaseReferenceRepo()
+
+	primaryURL := ""
+	if cloneURL != input.Source.RepoUrl {
+		primaryURL = input.Source.RepoUrl
+	}
+
+	git := common.NewGitRunner(os.Args[1])
+
+	if len(sparsePaths) > 0 {
+		common.HandleFatalError(
+			inlib.SetupSparseCheckout(git, input.Version.Ref, sparsePaths),
+			"Error setting up sparse checkout",
+		)
+	}
+
+	checkedOutRef, err := inlib.CheckoutRef(git, input, pullRequest, primaryURL)
+	common.HandleFatalError(err, "Error checking out ref")
+
+	if checkedOutRef != input.Version.Ref {
+		metadata = append(metadata, common.ConcourseMetadataField{Name: "built_ref", Value: checkedOutRef})
+	}
+
+	mergeBase := ""
+	if input.Params.PRDiff || input.Params.VerifySignatures == common.VerifySignaturesCommits || (input.Params.PRCommits && pullRequest == nil) {
+		targetBranch, err := inlib.TargetBranch(git, input, pullRequest)
+		common.HandleFatalError(err, "Error determining target branch")
+
+		mergeBase, err = inlib.MergeBase(git, targetBranch)
+		common.HandleFatalError(err, "Error determining merge base with target branch")
+	}
+
+	if input.Params.VerifySignatures != "" {
+		signatureBase := ""
+		if input.Params.VerifySignatures == common.VerifySignaturesCommits {
+			signatureBase = mergeBase
+		}
+
+		signers, err := inlib.VerifySignatures(git, signatureBase)
+		common.HandleFatalError(err, "Error verifying commit signatures")
+
+		metadata = append(metadata, common.ConcourseMetadataField{Name: "signers", Value: strings.Join(signers, ", ")})
+	}
+
+	if submoduleArgs := inlib.SubmoduleUpdateArgs(input.Params); submoduleArgs != nil {
+		common.HandleFatalError(git.Run(submoduleArgs...), "Error updating submodules")
+	}
 
 	common.HandleFatalError(
-		common.RunGitCommand("config concourse-ci.branch-name %s", input.Version.ChangedBranch),
+		git.Run("config", "concourse-ci.branch-name", input.Version.ChangedBranch),
 		"Error adding branch to git config",
 	)
 
 	common.HandleFatalError(
-		common.RunGitCommand("config concourse-ci.prs-list %s", strings.Join(input.Version.Branches, ",")),
+		git.Run("config", "concourse-ci.prs-list", strings.Join(input.Version.Branches, ",")),
 		"Error adding branch to git config",
 	)
 
-	common.HandleFatalError(common.OutputVersion(input.Version), "Error marshaling version json")
+	common.HandleFatalError(inlib.WriteVersionFiles(input, pullRequest), "Error writing version files")
 
-	common.HandleFatalError(
-		common.RunGitCommandSaveOutputToFile("--no-pager log -1 --pretty=format:\"%ae\"", "committer"),
-		"Error fetching git committer",
-	)
+	if input.Params.PRDiff {
+		var diffMatcher *checklib.PathMatcher
+		if input.Params.PRDiffPathsOnly {
+			diffMatcher, err = checklib.NewPathMatcher(checklib.SourcePathPatterns(input.Source))
+			common.HandleFatalError(err, "Error parsing paths")
+		}
 
-	common.HandleFatalError(
-		common.RunGitCommandSaveOutputToFile("log -1 --format=format:%B", "commit_message"),
-		"Error fetching git commit message",
-	)
+		common.HandleFatalError(inlib.WritePullRequestDiff(git, mergeBase, diffMatcher), "Error writing pull request diff")
+	}
+
+	if input.Params.PRCommits {
+		common.HandleFatalError(inlib.WritePullRequestCommits(git, input, pullRequest, checkedOutRef, mergeBase), "Error writing pull request commits")
+	}
+
+	if input.Params.PRActivities {
+		common.HandleFatalError(inlib.WritePullRequestActivities(input, pullRequest, checkedOutRef), "Error writing pull request activities")
+	}
+
+	common.HandleFatalError(inlib.WriteCommitFiles(git), "Error writing git committer and commit message")
 
+	common.HandleFatalError(common.OutputVersion(input.Version, metadata), "Error marshaling version json")
 }
@@ -0,0 +1,49 @@
+package inlib
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"../common"
+)
+
+// DefaultActivitiesLimit the number of activities and build statuses written when the pr_activities_limit param is absent
+const DefaultActivitiesLimit = 1000
+
+// WritePullRequestActivities writes the activities of the pull request and the build statuses of the ref to the resource directory
+func WritePullRequestActivities(input common.ConcourseInput, pullRequest *common.StashPullRequest, ref string) error {
+	if pullRequest == nil {
+		return errors.New("Cannot fetch activities without an open pull request")
+	}
+
+	limit := input.Params.PRActivitiesLimit
+	if limit <= 0 {
+		limit = DefaultActivitiesLimit
+	}
+
+	activities, more, err := common.GetStashPagedValues(
+		common.StashRepoURL(input.Source, "/pull-requests/%d/activities", pullRequest.ID), 100, limit)
+	if err != nil {
+		return err
+	}
+	if more {
+		fmt.Fprintf(os.Stderr, "Warning: pull request %d has more than %d activities, only the latest were written\n", pullRequest.ID, limit)
+	}
+
+	err = common.WriteResourceJSON("activities.json", activities)
+	if err != nil {
+		return err
+	}
+
+	buildStatuses, more, err := common.GetStashPagedValues(
+		common.StashBuildStatusURL(input.Source, "/commits/%s", ref), 100, limit)
+	if err != nil {
+		return err
+	}
+	if more {
+		fmt.Fprintf(os.Stderr, "Warning: commit %s has more than %d build statuses, only the latest were written\n", ref, limit)
+	}
+
+	return common.WriteResourceJSON("build_statuses.json", buildStatuses)
+}
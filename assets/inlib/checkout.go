@@ -0,0 +1,227 @@
+package inlib
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"../common"
+)
+
+// RefRewrittenError the error returned when the ref of the version is no longer reachable, usually because the branch was force-pushed
+type RefRewrittenError struct {
+	Ref    string
+	Branch string
+}
+
+func (e *RefRewrittenError) Error() string {
+	return fmt.Sprintf("Ref %s was rewritten on branch %s and is no longer reachable, "+
+		"set build_head_if_rewritten to build the new head of the branch instead", e.Ref, e.Branch)
+}
+
+// refFetch a refspec fetched from a remote, which is a remote name or URL, when looking for the ref of the version
+type refFetch struct {
+	Remote  string
+	Refspec string
+}
+
+// forkRemoteRefPrefix the prefix of the refs the heads of pull requests from forks are fetched into
+const forkRemoteRefPrefix = "refs/remotes/fork/"
+
+// IsFork returns true if the version was emitted for a pull request from a fork, whose branch isn't in the repo
+func IsFork(input common.ConcourseInput) bool {
+	return input.Version.SourceRepo != ""
+}
+
+// CloneBranch returns the branch which is cloned, the target branch of the pull request for forks and the changed branch otherwise
+func CloneBranch(input common.ConcourseInput) string {
+	if IsFork(input) && input.Version.TargetBranch != "" {
+		return input.Version.TargetBranch
+	}
+
+	return input.Version.ChangedBranch
+}
+
+// ResolveRepo returns the input with the source pointing to the repo of the version when the source watches several repos
+func ResolveRepo(input common.ConcourseInput) (common.ConcourseInput, error) {
+	repo := input.Version.Repo
+	if repo == "" {
+		return input, nil
+	}
+
+	input.Source.RepoName = repo
+	input.Source.Repos = nil
+	input.Source.RepoPattern = ""
+
+	mirrorURLs := common.StringList{}
+	for _, mirrorURL := range input.Source.MirrorUrls {
+		mirrorURLs = append(mirrorURLs, replaceRepoSegment(mirrorURL, repo))
+	}
+	input.Source.MirrorUrls = mirrorURLs
+
+	if common.HasStashConfig(input.Source) {
+		repository, err := common.GetStashRepository(input.Source)
+		if err == nil {
+			if cloneURL := cloneLink(repository, input.Source); cloneURL != "" {
+				input.Source.RepoUrl = cloneURL
+				return input, nil
+			}
+		} else {
+			fmt.Fprintln(os.Stderr, "Warning: could not read the clone URL of repo "+repo+":", err.Error())
+		}
+	}
+
+	if input.Source.RepoUrl == "" {
+		return input, fmt.Errorf("Cannot find the clone URL of repo %s without repo or the stash values", repo)
+	}
+
+	input.Source.RepoUrl = replaceRepoSegment(input.Source.RepoUrl, repo)
+	return input, nil
+}
+
+// cloneLink returns the clone link of the repository with the protocol and credentials of the repo of the source
+func cloneLink(repository common.StashRepository, source common.ConcourseSource) string {
+	name := "http"
+	if strings.HasPrefix(source.RepoUrl, "ssh://") || (source.RepoUrl == "" && source.PrivateKey != "") ||
+		(strings.Contains(source.RepoUrl, "@") && !strings.Contains(source.RepoUrl, "://")) {
+		name = "ssh"
+	}
+
+	for _, link := range repository.Links.Clone {
+		if link.Name == name && name == "http" {
+			return withUserInfo(link.Href, source.RepoUrl)
+		}
+		if link.Name == name {
+			return link.Href
+		}
+	}
+
+	return ""
+}
+
+// withUserInfo returns the clone URL with the user info of the repo URL, when it has one
+func withUserInfo(cloneURL string, repoURL string) string {
+	parsedRepoURL, err := url.Parse(repoURL)
+	if err != nil || parsedRepoURL.User == nil {
+		return cloneURL
+	}
+
+	parsedCloneURL, err := url.Parse(cloneURL)
+	if err != nil {
+		return cloneURL
+	}
+
+	parsedCloneURL.User = parsedRepoURL.User
+	return parsedCloneURL.String()
+}
+
+// replaceRepoSegment returns the clone URL with its last path segment replaced by the given repo
+func replaceRepoSegment(cloneURL string, repo string) string {
+	trimmed := strings.TrimSuffix(cloneURL, "/")
+
+	separator := strings.LastIndexAny(trimmed, "/:")
+	if separator < 0 {
+		return cloneURL
+	}
+
+	if strings.HasSuffix(trimmed, ".git") {
+		repo += ".git"
+	}
+
+	return trimmed[:separator+1] + repo
+}
+
+// CloneURLs returns the URLs the repo is cloned from, in the order they are tried: the mirrors of the source, then the primary repo
+func CloneURLs(source common.ConcourseSource) []string {
+	return append(append([]string{}, source.MirrorUrls...), source.RepoUrl)
+}
+
+// Clone clones the branch of the version into the destination from the first of the clone URLs which succeeds and returns that URL
+func Clone(input common.ConcourseInput, sparsePaths []string, referenceRepo string, destination string) (string, error) {
+	var err error
+	for _, cloneURL := range CloneURLs(input.Source) {
+		err = common.NewGitRunner("").Run(CloneArgs(input, cloneURL, sparsePaths, referenceRepo, destination)...)
+		if err == nil {
+			return cloneURL, nil
+		}
+
+		fmt.Fprintf(os.Stderr, "Warning: could not clone from %s: %s\n", common.RedactURL(cloneURL), err.Error())
+	}
+
+	return "", err
+}
+
+// CheckoutRef checks out the ref of the version, fetching it when the branch no longer contains it, and returns the checked out SHA
+func CheckoutRef(git *common.GitRunner, input common.ConcourseInput, pullRequest *common.StashPullRequest, primaryURL string) (string, error) {
+	ref := input.Version.Ref
+
+	if git.Run("checkout", "-q", ref) == nil {
+		return ref, nil
+	}
+
+	for _, fetch := range refFetches(input, pullRequest, primaryURL) {
+		fmt.Fprintf(os.Stderr, "Ref %s is not on branch %s, fetching %s from %s\n", ref, input.Version.ChangedBranch, fetch.Refspec, common.RedactURL(fetch.Remote))
+		if git.Run("fetch", "-q", fetch.Remote, fetch.Refspec) != nil {
+			continue
+		}
+
+		if git.Run("checkout", "-q", ref) == nil {
+			return ref, nil
+		}
+	}
+
+	rewrittenErr := &RefRewrittenError{Ref: ref, Branch: input.Version.ChangedBranch}
+	if !input.Params.BuildHeadIfRewritten {
+		return "", rewrittenErr
+	}
+
+	headRef := "refs/remotes/origin/" + input.Version.ChangedBranch
+	if IsFork(input) {
+		headRef = forkRemoteRefPrefix + input.Version.ChangedBranch
+	}
+
+	fmt.Fprintf(os.Stderr, "Ref %s was rewritten on branch %s, building the head of the branch instead\n", ref, input.Version.ChangedBranch)
+	err := git.Run("checkout", "-q", headRef)
+	if err != nil {
+		return "", err
+	}
+
+	return git.Output("rev-parse", "HEAD")
+}
+
+// refFetches returns the fetches tried in order to find the ref of the version, primaryURL is empty when origin is the primary repo
+func refFetches(input common.ConcourseInput, pullRequest *common.StashPullRequest, primaryURL string) []refFetch {
+	fetches := []refFetch{}
+
+	// a mirror which hasn't synced the latest push yet is the most likely reason for the ref to be missing,
+	// while the branch of a fork is never in the repo
+	if primaryURL != "" && !IsFork(input) {
+		fetches = append(fetches, refFetch{Remote: primaryURL, Refspec: "refs/heads/" + input.Version.ChangedBranch})
+	}
+
+	pullRequestID := input.Version.PullRequestID
+	if pullRequest != nil {
+		pullRequestID = fmt.Sprintf("%d", pullRequest.ID)
+	}
+
+	refspecs := []string{}
+	if pullRequestID != "" {
+		refspec := fmt.Sprintf("refs/pull-requests/%s/from", pullRequestID)
+		// the head of a fork is kept so that it can be built when the ref was rewritten
+		if IsFork(input) {
+			refspec = "+" + refspec + ":" + forkRemoteRefPrefix + input.Version.ChangedBranch
+		}
+		refspecs = append(refspecs, refspec)
+	}
+	refspecs = append(refspecs, input.Version.Ref)
+
+	for _, refspec := range refspecs {
+		fetches = append(fetches, refFetch{Remote: "origin", Refspec: refspec})
+		if primaryURL != "" {
+			fetches = append(fetches, refFetch{Remote: primaryURL, Refspec: refspec})
+		}
+	}
+
+	return fetches
+}
@@ -0,0 +1,152 @@
+package inlib
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"../common"
+)
+
+// CommitPerson the structure of the author or committer of a commit written by in
+type CommitPerson struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+// CommitTrailer the structure of a single trailer, such as Signed-off-by, of a commit message
+type CommitTrailer struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// PullRequestCommit the structure of a single commit of the pull request written by in
+type PullRequestCommit struct {
+	SHA                string          `json:"sha"`
+	Author             CommitPerson    `json:"author"`
+	AuthorTimestamp    int64           `json:"author_timestamp"`
+	Committer          CommitPerson    `json:"committer"`
+	CommitterTimestamp int64           `json:"committer_timestamp"`
+	Message            string          `json:"message"`
+	Trailers           []CommitTrailer `json:"trailers"`
+}
+
+var trailerPattern = regexp.MustCompile(`^([A-Za-z0-9][A-Za-z0-9-]*):\s*(.*)$`)
+
+// WritePullRequestCommits writes the commits up to the ref, oldest first, read from Stash when the pull request is known
+func WritePullRequestCommits(git *common.GitRunner, input common.ConcourseInput, pullRequest *common.StashPullRequest, ref string, mergeBase string) error {
+	if pullRequest != nil {
+		stashCommits, err := common.GetStashPullRequestCommits(input.Source, pullRequest.ID)
+		if err != nil {
+			return err
+		}
+
+		if stashCommits, found := commitsUntil(stashCommits, ref); found {
+			commits := []PullRequestCommit{}
+			for i := len(stashCommits) - 1; i >= 0; i-- {
+				commits = append(commits, fromStashCommit(stashCommits[i]))
+			}
+			return common.WriteResourceJSON("commits.json", commits)
+		}
+
+		// the pull request was rewritten since the ref, its commits are then listed from the clone
+		if git == nil {
+			return fmt.Errorf("Commit %s is no longer one of the commits of pull request %d", ref, pullRequest.ID)
+		}
+		if mergeBase == "" {
+			mergeBase, err = MergeBase(git, pullRequest.ToRef.DisplayID)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if mergeBase == "" {
+		return errors.New("Cannot list pull request commits without a pull request or a merge base")
+	}
+
+	output, err := git.Output("log", "--reverse", "--format=%H%x00%an%x00%ae%x00%at%x00%cn%x00%ce%x00%ct%x00%B%x1e", mergeBase+"..HEAD")
+	if err != nil {
+		return err
+	}
+
+	return common.WriteResourceJSON("commits.json", parseCommitLog(output))
+}
+
+// commitsUntil returns the commits, newest first, from the given ref on, and false if it isn't one of them
+func commitsUntil(commits []common.StashCommit, ref string) ([]common.StashCommit, bool) {
+	for i, commit := range commits {
+		if commit.ID == ref {
+			return commits[i:], true
+		}
+	}
+
+	return nil, false
+}
+
+func fromStashCommit(stashCommit common.StashCommit) PullRequestCommit {
+	return PullRequestCommit{
+		SHA:                stashCommit.ID,
+		Author:             CommitPerson{Name: stashCommit.Author.Name, Email: stashCommit.Author.EmailAddress},
+		AuthorTimestamp:    stashCommit.AuthorTimestamp,
+		Committer:          CommitPerson{Name: stashCommit.Committer.Name, Email: stashCommit.Committer.EmailAddress},
+		CommitterTimestamp: stashCommit.CommitterTimestamp,
+		Message:            stashCommit.Message,
+		Trailers:           parseTrailers(stashCommit.Message),
+	}
+}
+
+func parseCommitLog(output string) []PullRequestCommit {
+	commits := []PullRequestCommit{}
+
+	for _, record := range strings.Split(output, "\x1e") {
+		fields := strings.SplitN(strings.TrimLeft(record, "\n"), "\x00", 8)
+		if len(fields) != 8 {
+			continue
+		}
+
+		// git reports timestamps in seconds, they are written in milliseconds like the Stash REST API reports them
+		authorTimestamp, _ := strconv.ParseInt(fields[3], 10, 64)
+		committerTimestamp, _ := strconv.ParseInt(fields[6], 10, 64)
+		message := strings.TrimSpace(fields[7])
+
+		commits = append(commits, PullRequestCommit{
+			SHA:                fields[0],
+			Author:             CommitPerson{Name: fields[1], Email: fields[2]},
+			AuthorTimestamp:    authorTimestamp * 1000,
+			Committer:          CommitPerson{Name: fields[4], Email: fields[5]},
+			CommitterTimestamp: committerTimestamp * 1000,
+			Message:            message,
+			Trailers:           parseTrailers(message),
+		})
+	}
+
+	return commits
+}
+
+// parseTrailers returns the trailers of the last paragraph of a commit message, provided it isn't the subject and only holds trailers
+func parseTrailers(message string) []CommitTrailer {
+	trailers := []CommitTrailer{}
+
+	paragraphs := strings.Split(strings.TrimSpace(message), "\n\n")
+	if len(paragraphs) < 2 {
+		return trailers
+	}
+
+	for _, line := range strings.Split(paragraphs[len(paragraphs)-1], "\n") {
+		if len(trailers) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			trailers[len(trailers)-1].Value += " " + strings.TrimSpace(line)
+			continue
+		}
+
+		match := trailerPattern.FindStringSubmatch(line)
+		if match == nil {
+			return []CommitTrailer{}
+		}
+		trailers = append(trailers, CommitTrailer{Key: match[1], Value: strings.TrimSpace(match[2])})
+	}
+
+	return trailers
+}
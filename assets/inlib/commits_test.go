@@ -0,0 +1,78 @@
+package inlib
+
+import (
+	"testing"
+
+	"../common"
+)
+
+func TestParseTrailers(t *testing.T) {
+	message := "Add feature\n\nLonger description: with a colon.\n\nSigned-off-by: Joe User <joe.user@company.com>\nCo-authored-by: Jane User\n  <jane.user@company.com>"
+
+	trailers := parseTrailers(message)
+
+	if len(trailers) != 2 {
+		t.Error("Expected trailers to have length 2, got ", len(trailers))
+	} else {
+		if trailers[0].Key != "Signed-off-by" || trailers[0].Value != "Joe User <joe.user@company.com>" {
+			t.Error("Expected first trailer to be Signed-off-by, got ", trailers[0])
+		}
+		if trailers[1].Key != "Co-authored-by" || trailers[1].Value != "Jane User <jane.user@company.com>" {
+			t.Error("Expected folded Co-authored-by trailer, got ", trailers[1])
+		}
+	}
+}
+
+func TestParseTrailers_SubjectOnly(t *testing.T) {
+	trailers := parseTrailers("Fix: the build")
+
+	if len(trailers) != 0 {
+		t.Error("Expected trailers to have length 0, got ", len(trailers))
+	}
+}
+
+func TestParseTrailers_NotAllTrailers(t *testing.T) {
+	trailers := parseTrailers("Add feature\n\nSigned-off-by: Joe User\nthis line is prose")
+
+	if len(trailers) != 0 {
+		t.Error("Expected trailers to have length 0, got ", len(trailers))
+	}
+}
+
+func TestParseCommitLog(t *testing.T) {
+	output := "aaaa\x00Joe User\x00joe.user@company.com\x001540000000\x00Jane User\x00jane.user@company.com\x001540000100\x00Add feature\n\nSigned-off-by: Joe User\n\x1e\n" +
+		"bbbb\x00Joe User\x00joe.user@company.com\x001540000200\x00Joe User\x00joe.user@company.com\x001540000200\x00Fix typo\n\x1e"
+
+	commits := parseCommitLog(output)
+
+	if len(commits) != 2 {
+		t.Error("Expected commits to have length 2, got ", len(commits))
+	} else {
+		if commits[0].SHA != "aaaa" || commits[0].Committer.Email != "jane.user@company.com" {
+			t.Error("Expected first commit to be aaaa committed by Jane User, got ", commits[0])
+		}
+		if commits[0].AuthorTimestamp != 1540000000000 {
+			t.Error("Expected author timestamp in milliseconds, got ", commits[0].AuthorTimestamp)
+		}
+		if len(commits[0].Trailers) != 1 {
+			t.Error("Expected first commit to have 1 trailer, got ", len(commits[0].Trailers))
+		}
+		if commits[1].Message != "Fix typo" {
+			t.Error("Expected second commit message to be 'Fix typo', got ", commits[1].Message)
+		}
+	}
+}
+
+func TestCommitsUntil(t *testing.T) {
+	stashCommits := []common.StashCommit{{ID: "sha-pushed-later"}, {ID: "sha-ref"}, {ID: "sha-first"}}
+
+	commits, found := commitsUntil(stashCommits, "sha-ref")
+
+	if !found || len(commits) != 2 || commits[0].ID != "sha-ref" || commits[1].ID != "sha-first" {
+		t.Error("Expected the commits from sha-ref on, got ", found, commits)
+	}
+
+	if _, found = commitsUntil(stashCommits, "sha-rewritten"); found {
+		t.Error("Expected sha-rewritten not to be found")
+	}
+}
@@ -0,0 +1,110 @@
+package inlib
+
+import (
+	"strconv"
+	"strings"
+
+	"../checklib"
+	"../common"
+)
+
+// DiffStat the structure of the added and removed line counts of a single file of the pull request diff
+type DiffStat struct {
+	Path    string `json:"path"`
+	Added   int    `json:"added"`
+	Removed int    `json:"removed"`
+	Binary  bool   `json:"binary"`
+}
+
+// DiffSummary the structure of the pull request diff summary written by in
+type DiffSummary struct {
+	Files   []DiffStat `json:"files"`
+	Added   int        `json:"added"`
+	Removed int        `json:"removed"`
+}
+
+// WritePullRequestDiff writes the diff, patch and diff summary since the merge base, restricted to the files of the matcher if any
+func WritePullRequestDiff(git *common.GitRunner, mergeBase string, matcher *checklib.PathMatcher) error {
+	pathspec := []string{"--"}
+
+	if matcher != nil {
+		changedFiles, err := git.RawOutput("diff", "--name-only", "--no-renames", "-z", mergeBase, "HEAD")
+		if err != nil {
+			return err
+		}
+
+		for _, changedFile := range strings.Split(string(changedFiles), "\x00") {
+			if changedFile != "" && matcher.Matches(changedFile) {
+				pathspec = append(pathspec, ":(literal)"+changedFile)
+			}
+		}
+
+		// without any selected file the pathspec would select every file
+		if len(pathspec) == 1 {
+			return writeEmptyPullRequestDiff()
+		}
+	}
+
+	diff, err := git.RawOutput(append([]string{"diff", mergeBase, "HEAD"}, pathspec...)...)
+	if err != nil {
+		return err
+	}
+
+	err = common.WriteResourceFile("pr.diff", diff)
+	if err != nil {
+		return err
+	}
+
+	patch, err := git.RawOutput(append([]string{"format-patch", "--stdout", mergeBase + "..HEAD"}, pathspec...)...)
+	if err != nil {
+		return err
+	}
+
+	err = common.WriteResourceFile("pr.patch", patch)
+	if err != nil {
+		return err
+	}
+
+	numstat, err := git.Output(append([]string{"diff", "--numstat", "--no-renames", mergeBase, "HEAD"}, pathspec...)...)
+	if err != nil {
+		return err
+	}
+
+	return common.WriteResourceJSON("pr_diffstat.json", parseNumstat(numstat))
+}
+
+func writeEmptyPullRequestDiff() error {
+	for _, filename := range []string{"pr.diff", "pr.patch"} {
+		err := common.WriteResourceFile(filename, []byte{})
+		if err != nil {
+			return err
+		}
+	}
+
+	return common.WriteResourceJSON("pr_diffstat.json", parseNumstat(""))
+}
+
+func parseNumstat(numstat string) DiffSummary {
+	summary := DiffSummary{Files: []DiffStat{}}
+
+	for _, line := range strings.Split(numstat, "\n") {
+		fields := strings.SplitN(line, "\t", 3)
+		if len(fields) != 3 {
+			continue
+		}
+
+		stat := DiffStat{Path: fields[2]}
+		if fields[0] == "-" && fields[1] == "-" {
+			stat.Binary = true
+		} else {
+			stat.Added, _ = strconv.Atoi(fields[0])
+			stat.Removed, _ = strconv.Atoi(fields[1])
+		}
+
+		summary.Files = append(summary.Files, stat)
+		summary.Added += stat.Added
+		summary.Removed += stat.Removed
+	}
+
+	return summary
+}
@@ -0,0 +1,34 @@
+package inlib
+
+import (
+	"testing"
+)
+
+func TestParseNumstat(t *testing.T) {
+	numstat := "10\t2\tapi/server.go\n-\t-\tassets/logo.png\n0\t7\tREADME.md"
+
+	summary := parseNumstat(numstat)
+
+	if len(summary.Files) != 3 {
+		t.Error("Expected files to have length 3, got ", len(summary.Files))
+	} else {
+		if summary.Files[0].Path != "api/server.go" || summary.Files[0].Added != 10 || summary.Files[0].Removed != 2 {
+			t.Error("Expected first file to be api/server.go with 10 added and 2 removed, got ", summary.Files[0])
+		}
+		if !summary.Files[1].Binary {
+			t.Error("Expected second file to be binary, got ", summary.Files[1])
+		}
+	}
+
+	if summary.Added != 10 || summary.Removed != 9 {
+		t.Error("Expected totals of 10 added and 9 removed, got ", summary.Added, summary.Removed)
+	}
+}
+
+func TestParseNumstat_Empty(t *testing.T) {
+	summary := parseNumstat("")
+
+	if len(summary.Files) != 0 {
+		t.Error("Expected files to have length 0, got ", len(summary.Files))
+	}
+}
@@ -0,0 +1,294 @@
+package inlib
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"../checklib"
+	"../common"
+)
+
+// ValidateParams returns an errors object if validation of the in params doesn't pass, nil otherwise
+func ValidateParams(input common.ConcourseInput) error {
+	submodules := input.Params.Submodules
+	for _, submodule := range submodules {
+		if (submodule == common.SubmodulesAll || submodule == common.SubmodulesNone) && len(submodules) > 1 {
+			return fmt.Errorf("Submodules value '%s' cannot be combined with submodule paths", submodule)
+		}
+	}
+
+	if input.Params.SubmoduleDepth != nil && *input.Params.SubmoduleDepth < 0 {
+		return errors.New("Cannot pass a negative submodule_depth")
+	}
+
+	if input.Params.PRDiffPathsOnly && len(checklib.SourcePathPatterns(input.Source)) == 0 {
+		return errors.New("Cannot pass pr_diff_paths_only without paths or ignore_paths")
+	}
+
+	if _, err := checklib.NewPathMatcher(SparsePaths(input)); err != nil {
+		return err
+	}
+
+	if input.Params.PRActivities && !common.HasStashConfig(input.Source) {
+		return errors.New("Cannot pass pr_activities without stash_url, project_name and repo_name")
+	}
+
+	if input.Params.SkipDownload && (input.Params.PRDiff || input.Params.VerifySignatures != "") {
+		return errors.New("Cannot pass pr_diff or verify_signatures with skip_download")
+	}
+
+	switch input.Params.VerifySignatures {
+	case "":
+	case common.VerifySignaturesRef, common.VerifySignaturesCommits:
+		if input.Source.SigningKeys == "" && input.Source.AllowedSigners == "" {
+			return errors.New("Cannot pass verify_signatures without signing_keys or allowed_signers")
+		}
+	default:
+		return fmt.Errorf("Unknown verify_signatures value '%s'", input.Params.VerifySignatures)
+	}
+
+	return nil
+}
+
+// SubmoduleUpdateArgs returns the arguments of the git command updating the submodules requested by the params, or nil when none are wanted
+func SubmoduleUpdateArgs(params common.ConcourseParams) []string {
+	if len(params.Submodules) == 1 && params.Submodules[0] == common.SubmodulesNone {
+		return nil
+	}
+
+	args := []string{"submodule", "update", "--init"}
+
+	if params.SubmoduleRecursive == nil || *params.SubmoduleRecursive {
+		args = append(args, "--recursive")
+	}
+
+	if params.SubmoduleRemote {
+		args = append(args, "--remote")
+	}
+
+	// a depth of zero fetches the full history of the submodules
+	depth := 1
+	if params.SubmoduleDepth != nil {
+		depth = *params.SubmoduleDepth
+	}
+	if depth > 0 {
+		args = append(args, "--depth", fmt.Sprintf("%d", depth))
+	}
+
+	if len(params.Submodules) > 0 && params.Submodules[0] != common.SubmodulesAll {
+		args = append(args, "--")
+		args = append(args, params.Submodules...)
+	}
+
+	return args
+}
+
+// CloneArgs returns the arguments of the git command cloning the branch of the version from the given URL into the destination
+func CloneArgs(input common.ConcourseInput, cloneURL string, sparsePaths []string, referenceRepo string, destination string) []string {
+	args := []string{"clone", "--single-branch"}
+
+	if len(sparsePaths) > 0 {
+		args = append(args, "--filter=blob:none", "--no-checkout")
+	}
+
+	if referenceRepo != "" {
+		args = append(args, "--reference", referenceRepo, "--dissociate")
+	}
+
+	return append(args, cloneURL, "--branch", CloneBranch(input), destination)
+}
+
+// FindPullRequest returns the pull request of the version or of its changed branch, nil when there is none or Stash isn't configured
+func FindPullRequest(input common.ConcourseInput) (*common.StashPullRequest, error) {
+	if !common.HasStashConfig(input.Source) {
+		return nil, nil
+	}
+
+	if input.Version.PullRequestID != "" {
+		pullRequest, err := common.GetStashPullRequest(input.Source, input.Version.PullRequestID)
+		if err != nil {
+			return nil, err
+		}
+		return &pullRequest, nil
+	}
+
+	pullRequests, err := common.GetStashPullRequestsForBranch(input.Source, input.Version.ChangedBranch)
+	if err != nil || len(pullRequests) == 0 {
+		return nil, err
+	}
+
+	pullRequest := newestPullRequest(pullRequests)
+	if len(pullRequests) > 1 {
+		fmt.Fprintf(os.Stderr, "Branch %s has %d open pull requests, using the newest one, %d targeting %s\n",
+			input.Version.ChangedBranch, len(pullRequests), pullRequest.ID, pullRequest.ToRef.DisplayID)
+	}
+
+	return &pullRequest, nil
+}
+
+// newestPullRequest returns the most recently created of the pull requests, the one with the highest id on ties
+func newestPullRequest(pullRequests []common.StashPullRequest) common.StashPullRequest {
+	newest := pullRequests[0]
+	for _, pullRequest := range pullRequests[1:] {
+		if pullRequest.CreatedDate > newest.CreatedDate || (pullRequest.CreatedDate == newest.CreatedDate && pullRequest.ID > newest.ID) {
+			newest = pullRequest
+		}
+	}
+
+	return newest
+}
+
+// PullRequestRequired returns true if the params depend on the pull request of the version, failing to look it up is then an error
+func PullRequestRequired(params common.ConcourseParams) bool {
+	return params.SkipDownload || params.PRActivities || params.PRCommits || params.PRDiff
+}
+
+// PullRequestMetadata returns the metadata output describing the given pull request, which may be nil
+func PullRequestMetadata(pullRequest *common.StashPullRequest) []common.ConcourseMetadataField {
+	metadata := []common.ConcourseMetadataField{}
+	if pullRequest == nil {
+		return metadata
+	}
+
+	metadata = append(metadata,
+		common.ConcourseMetadataField{Name: "pr_id", Value: fmt.Sprintf("%d", pullRequest.ID)},
+		common.ConcourseMetadataField{Name: "title", Value: pullRequest.Title},
+		common.ConcourseMetadataField{Name: "author", Value: pullRequest.Author.User.DisplayName},
+		common.ConcourseMetadataField{Name: "target_branch", Value: pullRequest.ToRef.DisplayID},
+	)
+
+	if len(pullRequest.Links.Self) > 0 {
+		metadata = append(metadata, common.ConcourseMetadataField{Name: "url", Value: pullRequest.Links.Self[0].Href})
+	}
+
+	return metadata
+}
+
+// WriteVersionFiles writes the version, the values added to the git config and the pull request, when there is one, to the resource directory
+func WriteVersionFiles(input common.ConcourseInput, pullRequest *common.StashPullRequest) error {
+	err := common.WriteResourceJSON("version.json", &input.Version)
+	if err != nil {
+		return err
+	}
+
+	err = common.WriteResourceFile("branch-name", []byte(input.Version.ChangedBranch+"\n"))
+	if err != nil {
+		return err
+	}
+
+	err = common.WriteResourceFile("prs-list", []byte(strings.Join(input.Version.Branches, ",")+"\n"))
+	if err != nil {
+		return err
+	}
+
+	if pullRequest == nil {
+		return nil
+	}
+
+	return common.WriteResourceJSON("pr.json", pullRequest)
+}
+
+// TargetBranch returns the branch targeted by the given pull request or by the version, falling back to the default branch of the remote
+func TargetBranch(git *common.GitRunner, input common.ConcourseInput, pullRequest *common.StashPullRequest) (string, error) {
+	if pullRequest != nil {
+		return pullRequest.ToRef.DisplayID, nil
+	}
+
+	if input.Version.TargetBranch != "" {
+		return input.Version.TargetBranch, nil
+	}
+
+	output, err := git.Output("ls-remote", "--symref", "origin", "HEAD")
+	if err != nil {
+		return "", err
+	}
+
+	return parseDefaultBranch(output)
+}
+
+// MergeBase fetches the given target branch and returns the merge base of it and HEAD
+func MergeBase(git *common.GitRunner, targetBranch string) (string, error) {
+	err := git.Run("fetch", "-q", "origin", "+refs/heads/"+targetBranch+":refs/remotes/origin/"+targetBranch)
+	if err != nil {
+		return "", err
+	}
+
+	return git.Output("merge-base", "HEAD", "refs/remotes/origin/"+targetBranch)
+}
+
+func parseDefaultBranch(lsRemoteOutput string) (string, error) {
+	for _, line := range strings.Split(lsRemoteOutput, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 3 && fields[0] == "ref:" && fields[2] == "HEAD" {
+			return strings.TrimPrefix(fields[1], "refs/heads/"), nil
+		}
+	}
+
+	return "", errors.New("Could not determine the default branch of the remote")
+}
+
+// WriteCommitFiles writes the author email and the message of the checked out commit to .git/committer and .git/commit_message
+func WriteCommitFiles(git *common.GitRunner) error {
+	committer, err := git.Output("log", "-1", "--format=%ae")
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(git.Dir+"/.git/committer", []byte(committer), os.FileMode(0600))
+	if err != nil {
+		return err
+	}
+
+	message, err := git.Output("log", "-1", "--format=%B")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(git.Dir+"/.git/commit_message", []byte(message), os.FileMode(0600))
+}
+
+// SparsePaths returns the path patterns the checkout is restricted to, the paths and ignore_paths of the source by default
+func SparsePaths(input common.ConcourseInput) []string {
+	if input.Params.SparsePaths != nil {
+		return input.Params.SparsePaths
+	}
+
+	return checklib.SourcePathPatterns(input.Source)
+}
+
+// SetupSparseCheckout restricts the working tree to the given path patterns, in cone mode when they are all directories at the ref
+func SetupSparseCheckout(git *common.GitRunner, ref string, paths []string) error {
+	matcher, err := checklib.NewPathMatcher(paths)
+	if err != nil {
+		return err
+	}
+
+	cone := matcher.Literal()
+	for _, path := range matcher.Paths() {
+		if !cone {
+			break
+		}
+
+		objectType, err := git.Output("cat-file", "-t", ref+":"+path)
+		cone = err == nil && objectType == "tree"
+	}
+
+	return git.Run(SparseCheckoutArgs(matcher, cone)...)
+}
+
+// SparseCheckoutArgs returns the arguments of the git sparse-checkout command restricting the working tree to the paths of the matcher
+func SparseCheckoutArgs(matcher *checklib.PathMatcher, cone bool) []string {
+	args := []string{"sparse-checkout", "set"}
+
+	if cone {
+		args = append(args, "--cone")
+		return append(args, matcher.Paths()...)
+	}
+
+	// outside of cone mode the patterns are anchored to the root of the repo, like the matching done by check
+	args = append(args, "--no-cone")
+	return append(args, matcher.SparseCheckoutPatterns()...)
+}
@@ -0,0 +1,296 @@
+package inlib
+
+import (
+	"strings"
+	"testing"
+
+	"../checklib"
+	"../common"
+)
+
+func getConcourseInputFixture() common.ConcourseInput {
+	input := common.ConcourseInput{}
+	input.Source = common.ConcourseSource{}
+	input.Params = common.ConcourseParams{}
+
+	return input
+}
+
+func TestValidateParams_SubmodulesAllWithPaths(t *testing.T) {
+	input := getConcourseInputFixture()
+	input.Params.Submodules = common.StringList{"all", "lib/one"}
+
+	err := ValidateParams(input)
+
+	if err == nil {
+		t.Error("Expected non-nil error, got nil")
+	}
+}
+
+func TestValidateParams_SubmodulePaths(t *testing.T) {
+	input := getConcourseInputFixture()
+	input.Params.Submodules = common.StringList{"lib/one", "lib/two"}
+
+	err := ValidateParams(input)
+
+	if err != nil {
+		t.Error("Expected nil error, got ", err)
+	}
+}
+
+func TestValidateParams_NegativeSubmoduleDepth(t *testing.T) {
+	input := getConcourseInputFixture()
+	depth := -1
+	input.Params.SubmoduleDepth = &depth
+
+	err := ValidateParams(input)
+
+	if err == nil {
+		t.Error("Expected non-nil error, got nil")
+	}
+}
+
+func TestSubmoduleUpdateArgs_Default(t *testing.T) {
+	params := getConcourseInputFixture().Params
+
+	args := SubmoduleUpdateArgs(params)
+
+	if strings.Join(args, " ") != "submodule update --init --recursive --depth 1" {
+		t.Error("Expected default submodule args, got ", args)
+	}
+}
+
+func TestSubmoduleUpdateArgs_None(t *testing.T) {
+	params := getConcourseInputFixture().Params
+	params.Submodules = common.StringList{"none"}
+
+	args := SubmoduleUpdateArgs(params)
+
+	if args != nil {
+		t.Error("Expected nil submodule args, got ", args)
+	}
+}
+
+func TestSubmoduleUpdateArgs_PathsFullHistoryRemote(t *testing.T) {
+	params := getConcourseInputFixture().Params
+	params.Submodules = common.StringList{"lib/one", "lib/two with space"}
+	recursive := false
+	depth := 0
+	params.SubmoduleRecursive = &recursive
+	params.SubmoduleDepth = &depth
+	params.SubmoduleRemote = true
+
+	args := SubmoduleUpdateArgs(params)
+
+	if len(args) != 7 || args[6] != "lib/two with space" {
+		t.Error("Expected submodule args for paths, got ", args)
+	}
+}
+
+func TestCloneArgs_Default(t *testing.T) {
+	input := getConcourseInputFixture()
+	input.Source.RepoUrl = "ssh://git@stash.company.com/my_project/my_repo.git"
+	input.Version.ChangedBranch = "feature/my-branch"
+
+	args := CloneArgs(input, input.Source.RepoUrl, []string{}, "", "/tmp/build/get")
+
+	if strings.Join(args, " ") != "clone --single-branch ssh://git@stash.company.com/my_project/my_repo.git --branch feature/my-branch /tmp/build/get" {
+		t.Error("Expected default clone args, got ", args)
+	}
+}
+
+func TestCloneArgs_SparseWithReference(t *testing.T) {
+	input := getConcourseInputFixture()
+	input.Source.RepoUrl = "ssh://git@stash.company.com/my_project/my_repo.git"
+	input.Version.ChangedBranch = "feature/my-branch"
+
+	args := CloneArgs(input, input.Source.RepoUrl, []string{"api"}, "/var/cache/my_repo.git", "/tmp/build/get")
+
+	if strings.Join(args, " ") != "clone --single-branch --filter=blob:none --no-checkout --reference /var/cache/my_repo.git --dissociate "+
+		"ssh://git@stash.company.com/my_project/my_repo.git --branch feature/my-branch /tmp/build/get" {
+		t.Error("Expected sparse clone args with a reference, got ", args)
+	}
+}
+
+func TestSparsePaths_DefaultsToSourcePaths(t *testing.T) {
+	input := getConcourseInputFixture()
+	input.Source.Paths = []string{"api", "lib"}
+
+	paths := SparsePaths(input)
+
+	if len(paths) != 2 {
+		t.Error("Expected sparse paths to have length 2, got ", len(paths))
+	}
+}
+
+func TestSparsePaths_EmptyParamDisables(t *testing.T) {
+	input := getConcourseInputFixture()
+	input.Source.Paths = []string{"api", "lib"}
+	input.Params.SparsePaths = []string{}
+
+	paths := SparsePaths(input)
+
+	if len(paths) != 0 {
+		t.Error("Expected sparse paths to have length 0, got ", len(paths))
+	}
+}
+
+func getPathMatcherFixture(t *testing.T, patterns ...string) *checklib.PathMatcher {
+	matcher, err := checklib.NewPathMatcher(patterns)
+	if err != nil {
+		t.Fatal("Expected nil error, got ", err)
+	}
+
+	return matcher
+}
+
+func TestSparsePaths_DefaultsIncludeIgnorePaths(t *testing.T) {
+	input := getConcourseInputFixture()
+	input.Source.Paths = []string{"api"}
+	input.Source.IgnorePaths = []string{"api/docs"}
+
+	paths := SparsePaths(input)
+
+	if strings.Join(paths, " ") != "api !api/docs" {
+		t.Error("Expected sparse paths to be [api !api/docs], got ", paths)
+	}
+}
+
+func TestSparseCheckoutArgs_Cone(t *testing.T) {
+	args := SparseCheckoutArgs(getPathMatcherFixture(t, "api/", "/services/foo"), true)
+
+	if strings.Join(args, " ") != "sparse-checkout set --cone api services/foo" {
+		t.Error("Expected cone sparse-checkout args, got ", args)
+	}
+}
+
+func TestSparseCheckoutArgs_NoCone(t *testing.T) {
+	args := SparseCheckoutArgs(getPathMatcherFixture(t, "api", "Makefile"), false)
+
+	if strings.Join(args, " ") != "sparse-checkout set --no-cone /api /Makefile" {
+		t.Error("Expected non-cone sparse-checkout args, got ", args)
+	}
+}
+
+func TestSparseCheckoutArgs_Negations(t *testing.T) {
+	args := SparseCheckoutArgs(getPathMatcherFixture(t, "!docs", "services/**/src/*.go"), false)
+
+	if strings.Join(args, " ") != "sparse-checkout set --no-cone /* !/docs /services/**/src/*.go" {
+		t.Error("Expected non-cone sparse-checkout args with negations, got ", args)
+	}
+}
+
+func TestSparseCheckoutArgs_GlobAnyDepth(t *testing.T) {
+	args := SparseCheckoutArgs(getPathMatcherFixture(t, "api", "!*.md"), false)
+
+	if strings.Join(args, " ") != "sparse-checkout set --no-cone /api !*.md" {
+		t.Error("Expected the glob without slash not to be anchored, got ", args)
+	}
+}
+
+func TestValidateParams_InvalidSparsePath(t *testing.T) {
+	input := getConcourseInputFixture()
+	input.Params.SparsePaths = []string{"api/[docs"}
+
+	err := ValidateParams(input)
+
+	if err == nil {
+		t.Error("Expected non-nil error, got nil")
+	}
+}
+
+func TestParseDefaultBranch(t *testing.T) {
+	output := "ref: refs/heads/develop\tHEAD\n4d3a9c0b8f5f5e0c4e2cbb0d31b1b0b0c0ffee00\tHEAD"
+
+	branch, err := parseDefaultBranch(output)
+
+	if err != nil {
+		t.Error("Expected nil error, got ", err)
+	}
+
+	if branch != "develop" {
+		t.Error("Expected default branch to be develop, got ", branch)
+	}
+}
+
+func TestParseDefaultBranch_Missing(t *testing.T) {
+	_, err := parseDefaultBranch("4d3a9c0b8f5f5e0c4e2cbb0d31b1b0b0c0ffee00\tHEAD")
+
+	if err == nil {
+		t.Error("Expected non-nil error, got nil")
+	}
+}
+
+func TestPullRequestMetadata_NoPullRequest(t *testing.T) {
+	metadata := PullRequestMetadata(nil)
+
+	if len(metadata) != 0 {
+		t.Error("Expected metadata to have length 0, got ", len(metadata))
+	}
+}
+
+func TestPullRequestMetadata(t *testing.T) {
+	pullRequest := common.StashPullRequest{ID: 42, Title: "Add feature"}
+	pullRequest.ToRef.DisplayID = "master"
+	pullRequest.Author.User.DisplayName = "Joe User"
+	pullRequest.Links.Self = []common.StashLink{{Href: "https://stash.company.com/projects/P/repos/r/pull-requests/42"}}
+
+	metadata := PullRequestMetadata(&pullRequest)
+
+	if len(metadata) != 5 {
+		t.Error("Expected metadata to have length 5, got ", len(metadata))
+	} else {
+		if metadata[0].Name != "pr_id" || metadata[0].Value != "42" {
+			t.Error("Expected first metadata field to be pr_id 42, got ", metadata[0])
+		}
+		if metadata[4].Name != "url" || metadata[4].Value != "https://stash.company.com/projects/P/repos/r/pull-requests/42" {
+			t.Error("Expected last metadata field to be the url, got ", metadata[4])
+		}
+	}
+}
+
+func TestValidateParams_SkipDownloadWithPRDiff(t *testing.T) {
+	input := getConcourseInputFixture()
+	input.Params.SkipDownload = true
+	input.Params.PRDiff = true
+
+	err := ValidateParams(input)
+
+	if err == nil {
+		t.Error("Expected non-nil error, got nil")
+	}
+}
+
+func TestValidateParams_PRActivitiesWithoutStashConfig(t *testing.T) {
+	input := getConcourseInputFixture()
+	input.Params.PRActivities = true
+
+	err := ValidateParams(input)
+
+	if err == nil {
+		t.Error("Expected non-nil error, got nil")
+	}
+}
+
+func TestNewestPullRequest(t *testing.T) {
+	pullRequests := []common.StashPullRequest{{ID: 3, CreatedDate: 1000}, {ID: 5, CreatedDate: 3000}, {ID: 4, CreatedDate: 3000}, {ID: 9, CreatedDate: 2000}}
+
+	pullRequest := newestPullRequest(pullRequests)
+
+	if pullRequest.ID != 5 {
+		t.Error("Expected the newest pull request with the highest id, got ", pullRequest.ID)
+	}
+}
+
+func TestPullRequestRequired(t *testing.T) {
+	input := getConcourseInputFixture()
+
+	if PullRequestRequired(input.Params) {
+		t.Error("Expected the pull request not to be required without pull request params")
+	}
+
+	input.Params.PRActivities = true
+	if !PullRequestRequired(input.Params) {
+		t.Error("Expected the pull request to be required with pr_activities")
+	}
+}
@@ -0,0 +1,90 @@
+package inlib
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"syscall"
+
+	"../common"
+)
+
+var unsafeRepoNameCharacters = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// UpdateReferenceRepository updates the mirror of the repo in the reference cache and returns its path and a function releasing its lock
+func UpdateReferenceRepository(source common.ConcourseSource) (string, func(), error) {
+	err := os.MkdirAll(source.ReferenceCacheDir, os.FileMode(0700))
+	if err != nil {
+		return "", nil, err
+	}
+
+	referenceRepo := ReferenceRepositoryPath(source)
+
+	lockFile, err := os.OpenFile(referenceRepo+".lock", os.O_CREATE|os.O_RDWR, os.FileMode(0600))
+	if err != nil {
+		return "", nil, err
+	}
+
+	release := func() {
+		syscall.Flock(int(lockFile.Fd()), syscall.LOCK_UN)
+		lockFile.Close()
+	}
+
+	// the mirror is updated under an exclusive lock, concurrent builds then clone from it under shared locks
+	err = syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		lockFile.Close()
+		return "", nil, err
+	}
+
+	for _, cloneURL := range CloneURLs(source) {
+		err = updateMirror(referenceRepo, cloneURL)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		release()
+		return "", nil, err
+	}
+
+	err = syscall.Flock(int(lockFile.Fd()), syscall.LOCK_SH)
+	if err != nil {
+		release()
+		return "", nil, err
+	}
+
+	return referenceRepo, release, nil
+}
+
+// ReferenceRepositoryPath returns the path of the mirror of the repo within the reference cache directory of the source
+func ReferenceRepositoryPath(source common.ConcourseSource) string {
+	repoURL := source.RepoUrl
+	// the credentials of an http repo must not end up in the name of the mirror
+	if parsedURL, err := url.Parse(repoURL); err == nil && (parsedURL.Scheme == "http" || parsedURL.Scheme == "https") {
+		parsedURL.User = nil
+		repoURL = parsedURL.String()
+	}
+
+	return fmt.Sprintf("%s/%s.git", source.ReferenceCacheDir, unsafeRepoNameCharacters.ReplaceAllString(strings.TrimSuffix(repoURL, ".git"), "_"))
+}
+
+func updateMirror(referenceRepo string, repoURL string) error {
+	git := common.NewGitRunner(referenceRepo)
+
+	if _, err := os.Stat(referenceRepo); err == nil {
+		if git.Run("rev-parse", "--git-dir") == nil {
+			return git.Run("fetch", "-q", "--prune", repoURL, "+refs/*:refs/*")
+		}
+
+		// a mirror left broken by an interrupted clone is cloned again
+		err = os.RemoveAll(referenceRepo)
+		if err != nil {
+			return err
+		}
+	}
+
+	return common.NewGitRunner("").Run("clone", "-q", "--mirror", repoURL, referenceRepo)
+}
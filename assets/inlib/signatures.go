@@ -0,0 +1,82 @@
+package inlib
+
+import (
+	"fmt"
+	"strings"
+
+	"../common"
+)
+
+// CommitSignature the structure of the signature status of a single commit as reported by git
+type CommitSignature struct {
+	SHA    string
+	Status string
+	Signer string
+}
+
+// VerifySignatures returns the signers of HEAD, or of every commit since the merge base, an error listing the unverified SHAs otherwise
+func VerifySignatures(git *common.GitRunner, mergeBase string) ([]string, error) {
+	revisions := []string{"-1", "HEAD"}
+	if mergeBase != "" {
+		revisions = []string{mergeBase + "..HEAD"}
+	}
+
+	output, err := git.Output(append([]string{"log", "--format=%H%x09%G?%x09%GS"}, revisions...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	return checkSignatures(parseSignatureLog(output))
+}
+
+func parseSignatureLog(output string) []CommitSignature {
+	signatures := []CommitSignature{}
+	for _, line := range strings.Split(output, "\n") {
+		// the signer is empty for unsigned commits, which may have had its trailing separator trimmed
+		fields := strings.SplitN(line, "\t", 3)
+		if len(fields) < 2 {
+			continue
+		}
+
+		signature := CommitSignature{SHA: fields[0], Status: fields[1]}
+		if len(fields) == 3 {
+			signature.Signer = fields[2]
+		}
+		signatures = append(signatures, signature)
+	}
+
+	return signatures
+}
+
+func checkSignatures(signatures []CommitSignature) ([]string, error) {
+	signers := []string{}
+	unverified := []string{}
+
+	for _, signature := range signatures {
+		// only a good signature made by a key of the keyring given in the source is accepted
+		if signature.Status != "G" {
+			unverified = append(unverified, signature.SHA)
+			continue
+		}
+
+		if !containsString(signers, signature.Signer) {
+			signers = append(signers, signature.Signer)
+		}
+	}
+
+	if len(unverified) > 0 {
+		return signers, fmt.Errorf("Commits without a verified signature: %s", strings.Join(unverified, ", "))
+	}
+
+	return signers, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,52 @@
+package inlib
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseSignatureLog(t *testing.T) {
+	output := "aaaa\tG\tJoe User <joe.user@company.com>\nbbbb\tN"
+
+	signatures := parseSignatureLog(output)
+
+	if len(signatures) != 2 {
+		t.Error("Expected signatures to have length 2, got ", len(signatures))
+	} else if signatures[0].Signer != "Joe User <joe.user@company.com>" || signatures[1].Status != "N" {
+		t.Error("Expected parsed signatures, got ", signatures)
+	}
+}
+
+func TestCheckSignatures_AllGood(t *testing.T) {
+	signatures := []CommitSignature{
+		{SHA: "aaaa", Status: "G", Signer: "Joe User"},
+		{SHA: "bbbb", Status: "G", Signer: "Joe User"},
+		{SHA: "cccc", Status: "G", Signer: "Jane User"},
+	}
+
+	signers, err := checkSignatures(signatures)
+
+	if err != nil {
+		t.Error("Expected nil error, got ", err)
+	}
+
+	if len(signers) != 2 {
+		t.Error("Expected signers to have length 2, got ", len(signers))
+	}
+}
+
+func TestCheckSignatures_Unverified(t *testing.T) {
+	signatures := []CommitSignature{
+		{SHA: "aaaa", Status: "G", Signer: "Joe User"},
+		{SHA: "bbbb", Status: "N"},
+		{SHA: "cccc", Status: "U", Signer: "Unknown User"},
+	}
+
+	_, err := checkSignatures(signatures)
+
+	if err == nil {
+		t.Error("Expected non-nil error, got nil")
+	} else if !strings.Contains(err.Error(), "bbbb, cccc") {
+		t.Error("Expected error to list the offending SHAs, got ", err)
+	}
+}